@@ -35,6 +35,24 @@ func (f FuncRespHandler) Handle(resp *http.Response, ctx *ProxyCtx) *http.Respon
 	return f(resp, ctx)
 }
 
+// RoundTripHandler wraps sending requests to their destination, once the ReqHandlers let
+// them through. It is called instead of sending req, and calls next.RoundTrip(req, ctx) to
+// send it, possibly changing req, the response, or calling next several times or not at all.
+// This allows timing, retrying or caching requests without correlating a ReqHandler and a
+// RespHandler through ctx.UserData. The returned response is then filtered through the
+// RespHandlers, or if an error is returned, it is set in ctx.Error.
+type RoundTripHandler interface {
+	HandleRoundTrip(req *http.Request, ctx *ProxyCtx, next RoundTripper) (*http.Response, error)
+}
+
+// A wrapper that would convert a function to a RoundTripHandler interface type
+type FuncRoundTripHandler func(req *http.Request, ctx *ProxyCtx, next RoundTripper) (*http.Response, error)
+
+// FuncRoundTripHandler.HandleRoundTrip(req,ctx,next) <=> FuncRoundTripHandler(req,ctx,next)
+func (f FuncRoundTripHandler) HandleRoundTrip(req *http.Request, ctx *ProxyCtx, next RoundTripper) (*http.Response, error) {
+	return f(req, ctx, next)
+}
+
 // When a client send a CONNECT request to a host, the request is filtered through
 // all the HttpsHandlers the proxy has, and if one returns true, the connection is
 // sniffed using Man in the Middle attack.
@@ -55,3 +73,18 @@ type FuncHttpsHandler func(host string, ctx *ProxyCtx) (*ConnectAction, string)
 func (f FuncHttpsHandler) HandleConnect(host string, ctx *ProxyCtx) (*ConnectAction, string) {
 	return f(host, ctx)
 }
+
+// WebSocketHandler will "tamper" with the messages sent over a WebSocket connection
+// tunneled by the proxy, in either direction. The proxy will relay the returned message
+// instead of the original one. If HandleMessage returns nil the message is dropped.
+type WebSocketHandler interface {
+	HandleMessage(msg *WSMessage, dir Direction, ctx *ProxyCtx) *WSMessage
+}
+
+// A wrapper that would convert a function to a WebSocketHandler interface type
+type FuncWebSocketHandler func(msg *WSMessage, dir Direction, ctx *ProxyCtx) *WSMessage
+
+// FuncWebSocketHandler.HandleMessage(msg,dir,ctx) <=> FuncWebSocketHandler(msg,dir,ctx)
+func (f FuncWebSocketHandler) HandleMessage(msg *WSMessage, dir Direction, ctx *ProxyCtx) *WSMessage {
+	return f(msg, dir, ctx)
+}
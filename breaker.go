@@ -0,0 +1,299 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is the error of the requests failed fast by an open circuit breaker, see
+// Breakers
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets the requests through, counting their failures
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails the requests without sending them
+	BreakerOpen
+	// BreakerHalfOpen lets a few trial requests through, to tell whether the upstream
+	// recovered
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// breakerBuckets is the number of buckets the window of a breaker is divided into
+const breakerBuckets = 10
+
+// Breakers are the circuit breakers of the upstreams, one per Pool for the requests sent to
+// ctx.Upstream, and one per destination host for the others. A breaker opens when too many
+// of the requests sent in Window failed, that is could not be sent or were answered with a
+// 5xx status, or were too slow. While it is open, the requests fail right away with an
+// error of kind ErrorCircuitOpen. After OpenTimeout, it lets HalfOpenRequests requests
+// through, and closes if they all succeed, or opens again otherwise. The closed breakers
+// with no requests for a Window are dropped, with their counters.
+//	proxy.Breakers = &goproxy.Breakers{MinRequests: 20, ErrorRate: 0.5,
+//		SlowDuration: 5 * time.Second, SlowRate: 0.8, OpenTimeout: 30 * time.Second}
+type Breakers struct {
+	// Window is the duration over which the requests are counted, 10 seconds if zero
+	Window time.Duration
+	// MinRequests is the number of requests in Window below which a breaker does not open
+	MinRequests int
+	// ErrorRate is the ratio of failed requests opening a breaker, zero to never open on
+	// errors
+	ErrorRate float64
+	// SlowDuration is the time to the response headers above which a request is slow, and
+	// SlowRate the ratio of slow requests opening a breaker, zero to never open on latency
+	SlowDuration time.Duration
+	SlowRate     float64
+	// OpenTimeout is how long a breaker stays open, 10 seconds if zero
+	OpenTimeout time.Duration
+	// HalfOpenRequests is the number of trial requests of a half-open breaker, 1 if zero
+	HalfOpenRequests int
+	// OnStateChange, if not nil, is called when the breaker of key changes state
+	OnStateChange func(key string, from, to BreakerState)
+	mu            sync.Mutex
+	breakers      map[string]*breaker
+	// swept is when the idle breakers were last dropped, see sweep
+	swept time.Time
+}
+
+// BreakerStats are the counters of a circuit breaker, see Breakers.Stats
+type BreakerStats struct {
+	Key   string
+	State BreakerState
+	// Requests, Failures and Slow are counted over the window of the breaker
+	Requests, Failures, Slow int
+	// Rejected is the number of requests failed fast, and Trips the number of times the
+	// breaker opened
+	Rejected, Trips int64
+}
+
+type breakerBucket struct {
+	start                    int64
+	requests, failures, slow int
+}
+
+type breaker struct {
+	state BreakerState
+	// generation tells apart the requests let through in previous states, whose outcome
+	// is ignored
+	generation        uint64
+	openedAt          time.Time
+	buckets           [breakerBuckets]breakerBucket
+	trials, successes int
+	rejected, trips   int64
+	// last is when a request was last admitted or recorded
+	last time.Time
+}
+
+func (bs *Breakers) window() time.Duration {
+	if bs.Window <= 0 {
+		return 10 * time.Second
+	}
+	return bs.Window
+}
+
+func (bs *Breakers) openTimeout() time.Duration {
+	if bs.OpenTimeout <= 0 {
+		return 10 * time.Second
+	}
+	return bs.OpenTimeout
+}
+
+func (bs *Breakers) halfOpenRequests() int {
+	if bs.HalfOpenRequests <= 0 {
+		return 1
+	}
+	return bs.HalfOpenRequests
+}
+
+// bucket returns the bucket of b counting the requests at now
+func (bs *Breakers) bucket(b *breaker, now time.Time) *breakerBucket {
+	width := int64(bs.window()) / breakerBuckets
+	start := now.UnixNano() / width
+	bucket := &b.buckets[start%breakerBuckets]
+	if bucket.start != start {
+		*bucket = breakerBucket{start: start}
+	}
+	return bucket
+}
+
+// counts sums the requests of b in the window
+func (bs *Breakers) counts(b *breaker, now time.Time) (total breakerBucket) {
+	width := int64(bs.window()) / breakerBuckets
+	oldest := now.UnixNano()/width - breakerBuckets + 1
+	for _, bucket := range b.buckets {
+		if bucket.start >= oldest {
+			total.requests += bucket.requests
+			total.failures += bucket.failures
+			total.slow += bucket.slow
+		}
+	}
+	return total
+}
+
+// setState moves b to state, returning the call to OnStateChange to make once bs is
+// unlocked
+func (bs *Breakers) setState(key string, b *breaker, state BreakerState, now time.Time) func() {
+	from := b.state
+	b.state = state
+	b.generation++
+	b.trials, b.successes = 0, 0
+	switch state {
+	case BreakerOpen:
+		b.openedAt = now
+		b.trips++
+	case BreakerClosed:
+		b.buckets = [breakerBuckets]breakerBucket{}
+	}
+	return func() {
+		if bs.OnStateChange != nil {
+			bs.OnStateChange(key, from, state)
+		}
+	}
+}
+
+// sweep drops the closed breakers with no requests for a window, once per window, so that
+// there is no breaker left for every host ever requested, bs being locked
+func (bs *Breakers) sweep(now time.Time) {
+	if now.Sub(bs.swept) < bs.window() {
+		return
+	}
+	bs.swept = now
+	for key, b := range bs.breakers {
+		if b.state == BreakerClosed && now.Sub(b.last) >= bs.window() {
+			delete(bs.breakers, key)
+		}
+	}
+}
+
+// admit tells whether a request for key can be sent. If so, done must be called with its
+// outcome. bs may be nil, in which case all requests are sent.
+func (bs *Breakers) admit(key string, ctx *ProxyCtx) (done func(*http.Request, *http.Response, error, time.Duration), err error) {
+	if bs == nil {
+		return func(*http.Request, *http.Response, error, time.Duration) {}, nil
+	}
+	now := time.Now()
+	notify := func() {}
+	defer func() { notify() }()
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.breakers == nil {
+		bs.breakers = map[string]*breaker{}
+	}
+	bs.sweep(now)
+	b := bs.breakers[key]
+	if b == nil {
+		b = &breaker{}
+		bs.breakers[key] = b
+	}
+	b.last = now
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= bs.openTimeout() {
+		notify = bs.setState(key, b, BreakerHalfOpen, now)
+		ctx.Warnf("Circuit breaker of %v is half-open", key)
+	}
+	if b.state == BreakerOpen || (b.state == BreakerHalfOpen && b.trials >= bs.halfOpenRequests()) {
+		b.rejected++
+		return nil, &ProxyError{ErrorCircuitOpen, fmt.Errorf("%v: %w", key, ErrCircuitOpen)}
+	}
+	if b.state == BreakerHalfOpen {
+		b.trials++
+	}
+	generation := b.generation
+	return func(req *http.Request, resp *http.Response, err error, d time.Duration) {
+		bs.record(key, b, generation, req, resp, err, d, ctx)
+	}, nil
+}
+
+// record counts the outcome of a request let through by b in generation
+func (bs *Breakers) record(key string, b *breaker, generation uint64, req *http.Request, resp *http.Response, err error, d time.Duration, ctx *ProxyCtx) {
+	now := time.Now()
+	notify := func() {}
+	defer func() { notify() }()
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b.last = now
+	if generation != b.generation {
+		return
+	}
+	if req.Context().Err() != nil {
+		// the client hung up, which tells nothing about the upstream
+		if b.state == BreakerHalfOpen {
+			b.trials--
+		}
+		return
+	}
+	failed := err != nil || resp.StatusCode >= 500
+	slow := bs.SlowDuration > 0 && d >= bs.SlowDuration
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed || slow {
+			notify = bs.setState(key, b, BreakerOpen, now)
+			ctx.Warnf("Circuit breaker of %v is open again", key)
+		} else if b.successes++; b.successes >= bs.halfOpenRequests() {
+			notify = bs.setState(key, b, BreakerClosed, now)
+			ctx.Warnf("Circuit breaker of %v is closed", key)
+		}
+	case BreakerClosed:
+		bucket := bs.bucket(b, now)
+		bucket.requests++
+		if failed {
+			bucket.failures++
+		}
+		if slow {
+			bucket.slow++
+		}
+		total := bs.counts(b, now)
+		if total.requests < bs.MinRequests || total.requests == 0 {
+			return
+		}
+		if (bs.ErrorRate > 0 && float64(total.failures) >= bs.ErrorRate*float64(total.requests)) ||
+			(bs.SlowRate > 0 && float64(total.slow) >= bs.SlowRate*float64(total.requests)) {
+			notify = bs.setState(key, b, BreakerOpen, now)
+			ctx.Warnf("Circuit breaker of %v is open after %v failed and %v slow requests out of %v",
+				key, total.failures, total.slow, total.requests)
+		}
+	}
+}
+
+// State returns the state of the breaker of key
+func (bs *Breakers) State(key string) BreakerState {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if b := bs.breakers[key]; b != nil {
+		return b.state
+	}
+	return BreakerClosed
+}
+
+// Stats returns the counters of the breakers, sorted by key
+func (bs *Breakers) Stats() []BreakerStats {
+	now := time.Now()
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	stats := make([]BreakerStats, 0, len(bs.breakers))
+	for key, b := range bs.breakers {
+		total := bs.counts(b, now)
+		stats = append(stats, BreakerStats{Key: key, State: b.state, Requests: total.requests,
+			Failures: total.failures, Slow: total.slow, Rejected: b.rejected, Trips: b.trips})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Key < stats[j].Key })
+	return stats
+}
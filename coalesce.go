@@ -0,0 +1,342 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// errSpoolAborted is the error of the readers of a spool whose other readers all left
+// before the body was read entirely
+var errSpoolAborted = errors.New("coalesced response aborted")
+
+// spoolMemory is the size of the beginning of a shared body kept in memory, the rest being
+// written to a file
+const spoolMemory = 1 << 20
+
+// coalescer is the RoundTripHandler of Coalesce, sending the identical requests in flight
+// at the same time once
+type coalescer struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a request sent upstream, whose response the identical requests share
+type flight struct {
+	// header of the request sent, to tell which requests its response varies for
+	header http.Header
+	// ready is closed once the response or the error is known
+	ready chan struct{}
+	// head is the response, without its body, which is read from spool. It is nil if the
+	// response can't be shared.
+	head  *http.Response
+	err   error
+	spool *spool
+}
+
+// coalesceKey returns the key of the requests req can share a response with, or "" if it
+// can't. The requests of other users are never coalesced.
+func coalesceKey(req *http.Request) string {
+	if (req.Method != "GET" && req.Method != "HEAD") || req.Header.Get("Range") != "" ||
+		(req.Body != nil && req.Body != http.NoBody) {
+		return ""
+	}
+	return req.Method + " " + req.URL.String() + "\n" + req.Header.Get("Authorization") + "\n" +
+		strings.Join(req.Header.Values("Cookie"), "; ")
+}
+
+// shareable reports whether resp can be sent to the clients of other requests than its own
+func shareable(resp *http.Response) bool {
+	return resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusSwitchingProtocols &&
+		!headerHasToken(resp.Header, "Cache-Control", "private") &&
+		!headerHasToken(resp.Header, "Cache-Control", "no-store") &&
+		len(resp.Header.Values("Set-Cookie")) == 0 && !headerHasToken(resp.Header, "Vary", "*")
+}
+
+// varies reports whether the response to a request of header, whose Vary header is vary, may
+// differ for req
+func varies(vary http.Header, header http.Header, req *http.Request) bool {
+	for _, v := range vary.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if strings.Join(header.Values(name), ", ") != strings.Join(req.Header.Values(name), ", ") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *coalescer) HandleRoundTrip(req *http.Request, ctx *ProxyCtx, next RoundTripper) (*http.Response, error) {
+	key := coalesceKey(req)
+	if key == "" {
+		return next.RoundTrip(req, ctx)
+	}
+	c.mu.Lock()
+	f := c.flights[key]
+	if f == nil {
+		f = &flight{header: req.Header.Clone(), ready: make(chan struct{})}
+		c.flights[key] = f
+		c.mu.Unlock()
+		return c.lead(key, f, req, ctx, next)
+	}
+	c.mu.Unlock()
+
+	ctx.Logf("Waiting for the identical request in flight %v %v", req.Method, req.URL)
+	select {
+	case <-f.ready:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.head != nil && !varies(f.head.Header, f.header, req) {
+		if body := f.spool.newReader(); body != nil {
+			return f.response(req, body), nil
+		}
+	}
+	return next.RoundTrip(req, ctx)
+}
+
+// lead sends req for the requests of f
+func (c *coalescer) lead(key string, f *flight, req *http.Request, ctx *ProxyCtx, next RoundTripper) (*http.Response, error) {
+	done := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.flights[key] == f {
+			delete(c.flights, key)
+		}
+	}
+	// the request is sent on behalf of all the clients waiting for it, so it goes on if
+	// its own client hangs up
+	sendCtx, cancel := context.WithCancel(context.WithoutCancel(req.Context()))
+	shared := false
+	defer func() {
+		// the waiting requests are sent on their own if the response is not shared, even
+		// if next panics
+		if !shared {
+			done()
+		}
+		close(f.ready)
+	}()
+	resp, err := next.RoundTrip(req.WithContext(sendCtx), ctx)
+	if err != nil || !shareable(resp) {
+		f.err = err
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
+	}
+	head := *resp
+	head.Header, head.Trailer, head.Body = resp.Header.Clone(), nil, nil
+	f.head = &head
+	f.spool = &spool{src: resp.Body, dir: ctx.proxy.CoalesceDir, memory: spoolMemory,
+		cancel: cancel, done: done}
+	f.spool.cond = sync.NewCond(&f.spool.mu)
+	shared = true
+	return f.response(req, f.spool.newReader()), nil
+}
+
+// response returns the shared response to req, whose body is read from body. Its trailers
+// are not shared.
+func (f *flight) response(req *http.Request, body io.ReadCloser) *http.Response {
+	resp := *f.head
+	resp.Header = f.head.Header.Clone()
+	resp.Body, resp.Request = body, req
+	return &resp
+}
+
+// cancelBody cancels the context of its request once closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// spool is a response body read by several readers at their own pace. What is read from
+// src is kept in memory up to memory bytes, and the rest written to a temporary file in
+// dir, which the readers read from, the fastest reader reading src for the others. A
+// reader alone once the body outgrows memory reads src on its own, no file being written
+// for readers which may never come.
+type spool struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	src    io.ReadCloser
+	dir    string
+	memory int64
+	mem    []byte
+	// file holds what was read from src after mem
+	file *os.File
+	// written is the size of what was read from src, and err the error src failed with,
+	// io.EOF once it is read entirely
+	written int64
+	err     error
+	// reading is whether a reader is reading src
+	reading bool
+	readers int
+	// removed is whether the file was removed, once all the readers are done
+	removed bool
+	// owner, if not nil, is the reader which reads src alone, once it is the only one past
+	// memory or the file could not be written
+	owner  *spoolReader
+	cancel context.CancelFunc
+	// done removes the flight of the spool
+	done func()
+}
+
+// newReader returns a reader of the body from its start, or nil if the spool was aborted
+// or can't be read entirely
+func (s *spool) newReader() io.ReadCloser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == errSpoolAborted || s.removed || s.owner != nil {
+		return nil
+	}
+	s.readers++
+	return &spoolReader{s: s}
+}
+
+// finish records that src failed with err, removing the flight of s so that the next
+// requests are sent again, s being locked
+func (s *spool) finish(err error) {
+	s.err = err
+	s.src.Close()
+	s.cancel()
+	s.done()
+}
+
+// detach gives r sole ownership of src once what it read could not be written with err, the
+// other readers failing with err after reading what was written, s being locked
+func (s *spool) detach(r *spoolReader, err error) {
+	s.err, s.owner = err, r
+	s.done()
+}
+
+// write appends b to what was read from src, in memory up to s.memory and then in the file,
+// s being locked
+func (s *spool) write(b []byte) error {
+	if s.file == nil && int64(len(s.mem)+len(b)) <= s.memory {
+		s.mem = append(s.mem, b...)
+		s.written += int64(len(b))
+		return nil
+	}
+	if s.file == nil {
+		f, err := os.CreateTemp(s.dir, "goproxy-coalesce-*")
+		if err != nil {
+			return err
+		}
+		// the readers keep it open, so it is removed right away where open files can be,
+		// not to be left over if the proxy crashes
+		os.Remove(f.Name())
+		s.file = f
+	}
+	if _, err := s.file.WriteAt(b, s.written-int64(len(s.mem))); err != nil {
+		return err
+	}
+	s.written += int64(len(b))
+	return nil
+}
+
+type spoolReader struct {
+	s      *spool
+	off    int64
+	closed bool
+}
+
+func (r *spoolReader) Read(p []byte) (int, error) {
+	s := r.s
+	s.mu.Lock()
+	if s.owner == r {
+		s.mu.Unlock()
+		return s.src.Read(p)
+	}
+	for s.reading && r.off >= s.written && s.err == nil {
+		s.cond.Wait()
+	}
+	if r.off < int64(len(s.mem)) {
+		n := copy(p, s.mem[r.off:])
+		r.off += int64(n)
+		s.mu.Unlock()
+		return n, nil
+	}
+	if r.off < s.written {
+		n := int64(len(p))
+		if n > s.written-r.off {
+			n = s.written - r.off
+		}
+		file, off := s.file, r.off-int64(len(s.mem))
+		s.mu.Unlock()
+		m, err := file.ReadAt(p[:n], off)
+		r.off += int64(m)
+		return m, err
+	}
+	if s.err != nil {
+		s.mu.Unlock()
+		return 0, s.err
+	}
+	s.reading = true
+	s.mu.Unlock()
+
+	n, err := s.src.Read(p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reading = false
+	s.cond.Broadcast()
+	if n > 0 && s.file == nil && int64(len(s.mem)+n) > s.memory && s.readers == 1 {
+		// nobody else reads the body, which is too large to be kept for those who may come
+		s.mem = nil
+		s.detach(r, errSpoolAborted)
+		return n, err
+	}
+	if n > 0 {
+		if werr := s.write(p[:n]); werr != nil {
+			// the other readers can't read what this one got, but this one can go on
+			s.detach(r, werr)
+			return n, err
+		}
+	}
+	r.off += int64(n)
+	if err != nil {
+		s.finish(err)
+	}
+	return n, err
+}
+
+func (r *spoolReader) Close() error {
+	s := r.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if s.owner == r {
+		s.src.Close()
+		s.cancel()
+	}
+	if s.readers--; s.readers > 0 {
+		return nil
+	}
+	if s.err == nil {
+		// nobody is left to read the body
+		s.finish(errSpoolAborted)
+		s.cond.Broadcast()
+	}
+	s.removed = true
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+	}
+	return nil
+}
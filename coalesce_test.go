@@ -0,0 +1,111 @@
+package goproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSpoolWriteError(t *testing.T) {
+	// the file is opened read only, so what is read from src can't be written to it
+	f, err := ioutil.TempFile("", "goproxy-spool-test")
+	orFatal("TempFile", err, t)
+	f.Close()
+	file, err := os.Open(f.Name())
+	orFatal("Open", err, t)
+	defer os.Remove(f.Name())
+
+	body := strings.Repeat("bobo", 1000)
+	closed, cancelled, removed := false, false, false
+	s := &spool{
+		src: struct {
+			io.Reader
+			io.Closer
+		}{strings.NewReader(body), closerFunc(func() error { closed = true; return nil })},
+		file:   file,
+		cancel: func() { cancelled = true },
+		done:   func() { removed = true },
+	}
+	s.cond = sync.NewCond(&s.mu)
+	first, behind := s.newReader(), s.newReader()
+
+	b, err := ioutil.ReadAll(first)
+	orFatal("ReadAll", err, t)
+	if string(b) != body {
+		t.Errorf("the reader of src got %d bytes, expected %d", len(b), len(body))
+	}
+	if !removed {
+		t.Error("the flight should be removed once the spool can't be written")
+	}
+	if s.newReader() != nil {
+		t.Error("no reader should join a spool which can't be written")
+	}
+	if _, err := ioutil.ReadAll(behind); err == nil {
+		t.Error("the reader behind should fail")
+	}
+	if closed || cancelled {
+		t.Error("src should be left to its reader until it is closed")
+	}
+	first.Close()
+	behind.Close()
+	if !closed || !cancelled {
+		t.Error("src should be closed with its reader")
+	}
+}
+
+func TestSpoolMemory(t *testing.T) {
+	body := strings.Repeat("bobo", 1000)
+	newSpool := func() *spool {
+		s := &spool{
+			src:    ioutil.NopCloser(strings.NewReader(body)),
+			dir:    t.TempDir(),
+			memory: 600,
+			cancel: func() {},
+			done:   func() {},
+		}
+		s.cond = sync.NewCond(&s.mu)
+		return s
+	}
+
+	// a reader alone reads src on its own once past memory
+	s := newSpool()
+	r := s.newReader()
+	b, err := ioutil.ReadAll(r)
+	orFatal("ReadAll", err, t)
+	if string(b) != body {
+		t.Errorf("the reader alone got %d bytes, expected %d", len(b), len(body))
+	}
+	if s.file != nil || s.mem != nil {
+		t.Error("nothing should be kept for a reader alone")
+	}
+	if s.newReader() != nil {
+		t.Error("no reader should join once the body was not kept")
+	}
+	r.Close()
+
+	// the reader behind reads the beginning from memory and the rest from the file
+	s = newSpool()
+	first, behind := s.newReader(), s.newReader()
+	b, err = ioutil.ReadAll(first)
+	orFatal("ReadAll", err, t)
+	if string(b) != body {
+		t.Errorf("the first reader got %d bytes, expected %d", len(b), len(body))
+	}
+	if s.file == nil || len(s.mem) == 0 {
+		t.Fatal("the body should be kept in memory and in the file")
+	}
+	b, err = ioutil.ReadAll(behind)
+	orFatal("ReadAll", err, t)
+	if string(b) != body {
+		t.Errorf("the reader behind got %d bytes, expected %d", len(b), len(body))
+	}
+	first.Close()
+	behind.Close()
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
@@ -1,8 +1,10 @@
 package goproxy
 
 import (
+	"context"
 	"net/http"
 	"regexp"
+	"time"
 )
 
 // ProxyCtx is the Proxy context, contains useful information about every request. It is passed to
@@ -20,7 +22,39 @@ type ProxyCtx struct {
 	UserData interface{}
 	// Will connect a request to a response
 	Session int64
-	proxy   *ProxyHttpServer
+	// The CONNECT request of the man in the middle'd session Req was sent in, nil for the
+	// other requests
+	ConnectReq *http.Request
+	// The route a non-proxy request was sent through, nil for regular proxy requests
+	Route *Route
+	// The timeouts of the request, initialized from the proxy's Timeouts. A ReqHandler can
+	// change them before the request is sent.
+	Timeouts Timeouts
+	// The retry policy of the request, initialized from the proxy's Retry. A ReqHandler can
+	// change it before the request is sent.
+	Retry *RetryPolicy
+	// Upstream, if set, is the name of the Pool in proxy.Pools the request is sent to. It can
+	// be set by a ReqHandler, or by a CONNECT handler for a whole CONNECT session.
+	Upstream string
+	// Attempts are the tries at sending the request upstream, in order
+	Attempts []Attempt
+	// Network, if not nil, shapes the traffic of the client and of the connections to the
+	// upstream servers, see NetworkProfile. It can be set by a CONNECT handler for a whole
+	// CONNECT session, or by a ReqHandler for a request sent directly to the proxy.
+	Network *NetworkProfile
+	// see Context
+	context context.Context
+	// the Accept-Encoding of the client, and whether the proxy asked the server for the
+	// encodings it can decode instead, see negotiateEncoding
+	clientEncodings string
+	negotiated      bool
+	// whether the request already went through the proxy, see loopsBack
+	looped bool
+	// whether the client connection is shaped by Network already
+	shaped bool
+	// the connection to the destination of a plain HTTP man in the middle'd session
+	tunnel *connTransport
+	proxy  *ProxyHttpServer
 }
 
 type RoundTripper interface {
@@ -33,10 +67,88 @@ func (f RoundTripperFunc) RoundTrip(req *http.Request, ctx *ProxyCtx) (*http.Res
 	return f(req, ctx)
 }
 
-func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
+// Context returns the context of the request, which is cancelled when the client hangs up or
+// the proxy is forcibly shut down. It is passed to the request sent upstream. For CONNECT
+// handlers, it is the context of the whole session, the parent of the contexts of the
+// requests in the session.
+func (ctx *ProxyCtx) Context() context.Context {
+	if ctx.context == nil {
+		return context.Background()
+	}
+	return ctx.context
+}
+
+// RoundTrip sends req to its destination through the RoundTripHandlers of the proxy. If one
+// of them panics, the panic is returned as an error of kind ErrorHandlerPanic.
+func (ctx *ProxyCtx) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			resp, err = nil, ctx.proxy.recovered(ctx, v)
+		}
+	}()
+	return ctx.proxy.handlers.load().roundTrip.RoundTrip(req, ctx)
+}
+
+// sendRequest is the innermost RoundTripper, sending req with the timeouts and the retry
+// policy of ctx, which the RoundTripHandlers may have changed
+var sendRequest RoundTripperFunc = func(req *http.Request, ctx *ProxyCtx) (*http.Response, error) {
+	return ctx.Retry.roundTrip(req, ctx, sendOnce)
+}
+
+// sendOnce sends req, to an endpoint of ctx.Upstream if set, unless its circuit breaker is
+// open, recording the attempt in ctx.Attempts
+func sendOnce(req *http.Request, ctx *ProxyCtx) (*http.Response, error) {
+	return sendUpstream(req, ctx, func(req *http.Request) (*http.Response, error) {
+		return ctx.Timeouts.roundTrip(req, ctx.roundTrip)
+	})
+}
+
+// sendUpstream is sendOnce, req being sent by send once its destination is picked
+func sendUpstream(req *http.Request, ctx *ProxyCtx, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	// like http.RoundTripper, the body of req is closed even if it is not sent
+	e, err := ctx.proxy.Pools.endpoint(req, ctx)
+	if err != nil {
+		closeRequestBody(req)
+		ctx.Attempts = append(ctx.Attempts, Attempt{Error: err})
+		return nil, err
+	}
+	if e != nil {
+		req = e.rewrite(req)
+	}
+	if ctx.proxy.sendsToSelf(req, ctx) {
+		closeRequestBody(req)
+		return nil, &ProxyError{ErrorLoop, ErrLoopDetected}
+	}
+	key := ctx.Upstream
+	if key == "" {
+		key = req.URL.Host
+	}
+	done, err := ctx.proxy.Breakers.admit(key, ctx)
+	if err != nil {
+		closeRequestBody(req)
+		ctx.Attempts = append(ctx.Attempts, Attempt{Error: err})
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := e.roundTrip(req, ctx, send)
+	done(req, resp, err, time.Since(start))
+	ctx.Attempts = append(ctx.Attempts, Attempt{Error: err, Duration: time.Since(start), Response: resp, Endpoint: e})
+	return resp, err
+}
+
+func (ctx *ProxyCtx) roundTrip(req *http.Request) (*http.Response, error) {
 	if ctx.RoundTripper != nil {
 		return ctx.RoundTripper.RoundTrip(req, ctx)
 	}
+	if ctx.tunnel.serves(req) {
+		return ctx.tunnel.RoundTrip(req)
+	}
+	if p := ctx.Network; p != nil {
+		return ctx.proxy.shapedTransport(p.leg()).RoundTrip(req)
+	}
 	return ctx.proxy.Tr.RoundTrip(req)
 }
 
@@ -79,7 +191,17 @@ var charsetFinder = regexp.MustCompile("charset=([^ ;]*)")
 // Returns the empty string if we don't know which character set it used.
 // Currently it will look for charset=<charset> in the Content-Type header of the request.
 func (ctx *ProxyCtx) Charset() string {
-	charsets := charsetFinder.FindStringSubmatch(ctx.Resp.Header.Get("Content-Type"))
+	return headerCharset(ctx.Resp.Header)
+}
+
+// Will try to infer the character set of the request body from the request headers, like
+// Charset does for the response. Returns the empty string if the character set is unknown.
+func (ctx *ProxyCtx) ReqCharset() string {
+	return headerCharset(ctx.Req.Header)
+}
+
+func headerCharset(h http.Header) string {
+	charsets := charsetFinder.FindStringSubmatch(h.Get("Content-Type"))
 	if charsets == nil {
 		return ""
 	}
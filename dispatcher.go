@@ -2,10 +2,12 @@ package goproxy
 
 import (
 	"bytes"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -173,8 +175,8 @@ type ReqProxyConds struct {
 }
 
 // DoFunc is equivalent to proxy.OnRequest().Do(FuncReqHandler(f))
-func (pcond *ReqProxyConds) DoFunc(f func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response)) {
-	pcond.Do(FuncReqHandler(f))
+func (pcond *ReqProxyConds) DoFunc(f func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response)) *Handle {
+	return pcond.Do(FuncReqHandler(f))
 }
 
 // ReqProxyConds.Do will register the ReqHandler on the proxy,
@@ -184,8 +186,10 @@ func (pcond *ReqProxyConds) DoFunc(f func(req *http.Request, ctx *ProxyCtx) (*ht
 //	proxy.OnRequest(cond1,cond2).Do(handler)
 //	// given request to the proxy, will test if cond1.HandleReq(req,ctx) && cond2.HandleReq(req,ctx) are true
 //	// if they are, will call handler.Handle(req,ctx)
-func (pcond *ReqProxyConds) Do(h ReqHandler) {
-	pcond.proxy.reqHandlers = append(pcond.proxy.reqHandlers,
+//
+// The returned Handle can be used to name, prioritize or remove the handler.
+func (pcond *ReqProxyConds) Do(h ReqHandler) *Handle {
+	return pcond.proxy.handlers.add(RequestHandlers,
 		FuncReqHandler(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
 			for _, cond := range pcond.reqConds {
 				if !cond.HandleReq(r, ctx) {
@@ -196,6 +200,66 @@ func (pcond *ReqProxyConds) Do(h ReqHandler) {
 		}))
 }
 
+// DoRoundTripFunc is equivalent to proxy.OnRequest().DoRoundTrip(FuncRoundTripHandler(f))
+func (pcond *ReqProxyConds) DoRoundTripFunc(f func(req *http.Request, ctx *ProxyCtx, next RoundTripper) (*http.Response, error)) *Handle {
+	return pcond.DoRoundTrip(FuncRoundTripHandler(f))
+}
+
+// DoRoundTrip will register the RoundTripHandler on the proxy, h.HandleRoundTrip(req,ctx,next)
+// will be called around the round trip of every request that meets the conditions, in
+// ServeHTTP as well as in man in the middle'd connections. Handlers registered first (or
+// with a higher priority) wrap the ones registered after them. For example, to time requests
+//	proxy.OnRequest().DoRoundTripFunc(func(req *http.Request, ctx *goproxy.ProxyCtx,
+//		next goproxy.RoundTripper) (*http.Response, error) {
+//		start := time.Now()
+//		resp, err := next.RoundTrip(req, ctx)
+//		ctx.Logf("%v took %v", req.URL, time.Since(start))
+//		return resp, err
+//	})
+func (pcond *ReqProxyConds) DoRoundTrip(h RoundTripHandler) *Handle {
+	return pcond.proxy.handlers.add(RoundTripHandlers,
+		FuncRoundTripHandler(func(r *http.Request, ctx *ProxyCtx, next RoundTripper) (*http.Response, error) {
+			for _, cond := range pcond.reqConds {
+				if !cond.HandleReq(r, ctx) {
+					return next.RoundTrip(r, ctx)
+				}
+			}
+			return h.HandleRoundTrip(r, ctx, next)
+		}))
+}
+
+// Coalesce sends the identical GET and HEAD requests meeting the conditions once, while one
+// is in flight: the others wait for its response, and stream the same body at their own
+// pace. Requests are identical if they have the same method, URL, credentials and cookies,
+// and the same values of the headers the response varies by. Responses which are private,
+// set cookies or are partial are not shared, the waiting requests being sent on their own.
+// Each client gets its own response, filtered through the RespHandlers as usual. To
+// coalesce the requests missing a cache, register Coalesce before the cache
+//	proxy.OnRequest(goproxy.ReqHostIs("artifacts.example.com")).Coalesce()
+//	proxy.OnRequest().DoRoundTrip(c)
+func (pcond *ReqProxyConds) Coalesce() *Handle {
+	return pcond.DoRoundTrip(&coalescer{flights: map[string]*flight{}})
+}
+
+// ShapeNetwork shapes the traffic of the clients whose CONNECT sessions, or requests sent
+// directly to the proxy, meet the conditions, with the network profile p. For example,
+// to test a site over 3G
+//	proxy.OnRequest(goproxy.ReqHostIs("www.example.com:443")).ShapeNetwork(goproxy.Network3G)
+//
+// It returns the handles of the request handler and of the CONNECT handler setting
+// ctx.Network, which must run before the CONNECT handlers returning an action.
+func (pcond *ReqProxyConds) ShapeNetwork(p NetworkProfile) (req, connect *Handle) {
+	req = pcond.DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Network = &p
+		return r, nil
+	})
+	connect = pcond.HandleConnectFunc(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		ctx.Network = &p
+		return nil, host
+	})
+	return req, connect
+}
+
 // HandleConnect is used when proxy receives an HTTP CONNECT request,
 // it'll then use the HttpsHandler to determine what should it
 // do with this request. The handler returns a ConnectAction struct, the Action field in the ConnectAction
@@ -207,8 +271,8 @@ func (pcond *ReqProxyConds) Do(h ReqHandler) {
 // The ConnectAction struct contains possible tlsConfig that will be used for eavesdropping. If nil, the proxy
 // will use the default tls configuration.
 //	proxy.OnRequest().HandleConnect(goproxy.AlwaysReject) // rejects all CONNECT requests
-func (pcond *ReqProxyConds) HandleConnect(h HttpsHandler) {
-	pcond.proxy.httpsHandlers = append(pcond.proxy.httpsHandlers,
+func (pcond *ReqProxyConds) HandleConnect(h HttpsHandler) *Handle {
+	return pcond.proxy.handlers.add(ConnectHandlers,
 		FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
 			for _, cond := range pcond.reqConds {
 				if !cond.HandleReq(ctx.Req, ctx) {
@@ -231,12 +295,12 @@ func (pcond *ReqProxyConds) HandleConnect(h HttpsHandler) {
 //		}
 //		return RejectConnect, host
 //	})
-func (pcond *ReqProxyConds) HandleConnectFunc(f func(host string, ctx *ProxyCtx) (*ConnectAction, string)) {
-	pcond.HandleConnect(FuncHttpsHandler(f))
+func (pcond *ReqProxyConds) HandleConnectFunc(f func(host string, ctx *ProxyCtx) (*ConnectAction, string)) *Handle {
+	return pcond.HandleConnect(FuncHttpsHandler(f))
 }
 
-func (pcond *ReqProxyConds) HijackConnect(f func(req *http.Request, client net.Conn, ctx *ProxyCtx)) {
-	pcond.proxy.httpsHandlers = append(pcond.proxy.httpsHandlers,
+func (pcond *ReqProxyConds) HijackConnect(f func(req *http.Request, client net.Conn, ctx *ProxyCtx)) *Handle {
+	return pcond.proxy.handlers.add(ConnectHandlers,
 		FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
 			for _, cond := range pcond.reqConds {
 				if !cond.HandleReq(ctx.Req, ctx) {
@@ -257,14 +321,14 @@ type ProxyConds struct {
 }
 
 // ProxyConds.DoFunc is equivalent to proxy.OnResponse().Do(FuncRespHandler(f))
-func (pcond *ProxyConds) DoFunc(f func(resp *http.Response, ctx *ProxyCtx) *http.Response) {
-	pcond.Do(FuncRespHandler(f))
+func (pcond *ProxyConds) DoFunc(f func(resp *http.Response, ctx *ProxyCtx) *http.Response) *Handle {
+	return pcond.Do(FuncRespHandler(f))
 }
 
 // ProxyConds.Do will register the RespHandler on the proxy, h.Handle(resp,ctx) will be called on every
 // request that matches the conditions aggregated in pcond.
-func (pcond *ProxyConds) Do(h RespHandler) {
-	pcond.proxy.respHandlers = append(pcond.proxy.respHandlers,
+func (pcond *ProxyConds) Do(h RespHandler) *Handle {
+	handle := pcond.proxy.handlers.add(ResponseHandlers,
 		FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
 			for _, cond := range pcond.reqConds {
 				if !cond.HandleReq(ctx.Req, ctx) {
@@ -278,6 +342,10 @@ func (pcond *ProxyConds) Do(h RespHandler) {
 			}
 			return h.Handle(resp, ctx)
 		}))
+	if _, ok := h.(bodyHandler); ok {
+		handle.ReadsBodies()
+	}
+	return handle
 }
 
 // OnResponse is used when adding a response-filter to the HTTP proxy, usual pattern is
@@ -287,6 +355,45 @@ func (proxy *ProxyHttpServer) OnResponse(conds ...RespCondition) *ProxyConds {
 	return &ProxyConds{proxy, make([]ReqCondition, 0), conds}
 }
 
+// OnWebSocketMessage is used when adding a filter to the messages of WebSocket connections.
+// The conditions are tested against the handshake request of the connection, for example
+//	proxy.OnWebSocketMessage(goproxy.ReqHostIs("chat.example.com:443")).DoFunc(
+//		func(msg *goproxy.WSMessage, dir goproxy.Direction, ctx *goproxy.ProxyCtx) *goproxy.WSMessage {
+//			ctx.Logf("%v %s", dir, msg.Data)
+//			return msg
+//		})
+func (proxy *ProxyHttpServer) OnWebSocketMessage(conds ...ReqCondition) *WebSocketConds {
+	return &WebSocketConds{proxy, conds}
+}
+
+// WebSocketConds aggregate ReqConditions for a ProxyHttpServer. Upon calling Do, it will register
+// a WebSocketHandler that would handle the messages of WebSocket connections whose handshake
+// request meets all the conditions.
+type WebSocketConds struct {
+	proxy    *ProxyHttpServer
+	reqConds []ReqCondition
+}
+
+// WebSocketConds.DoFunc is equivalent to proxy.OnWebSocketMessage().Do(FuncWebSocketHandler(f))
+func (pcond *WebSocketConds) DoFunc(f func(msg *WSMessage, dir Direction, ctx *ProxyCtx) *WSMessage) *Handle {
+	return pcond.Do(FuncWebSocketHandler(f))
+}
+
+// WebSocketConds.Do will register the WebSocketHandler on the proxy. h.HandleMessage(msg,dir,ctx)
+// will be called, with ctx.Req set to the handshake request, on every message of matching
+// connections. Messages sent in both directions are handled concurrently.
+func (pcond *WebSocketConds) Do(h WebSocketHandler) *Handle {
+	return pcond.proxy.handlers.add(WebSocketHandlers,
+		FuncWebSocketHandler(func(msg *WSMessage, dir Direction, ctx *ProxyCtx) *WSMessage {
+			for _, cond := range pcond.reqConds {
+				if !cond.HandleReq(ctx.Req, ctx) {
+					return msg
+				}
+			}
+			return h.HandleMessage(msg, dir, ctx)
+		}))
+}
+
 // AlwaysMitm is a HttpsHandler that always eavesdrop https connections, for example to
 // eavesdrop all https connections to www.google.com, we can use
 //	proxy.OnRequest(goproxy.ReqHostIs("www.google.com")).HandleConnect(goproxy.AlwaysMitm)
@@ -302,11 +409,19 @@ var AlwaysReject FuncHttpsHandler = func(host string, ctx *ProxyCtx) (*ConnectAc
 	return RejectConnect, host
 }
 
+// bodyHandler is a RespHandler reading the bodies of the responses, whose Handle is marked
+// as such, see Handle.ReadsBodies
+type bodyHandler func(resp *http.Response, ctx *ProxyCtx) *http.Response
+
+func (f bodyHandler) Handle(resp *http.Response, ctx *ProxyCtx) *http.Response {
+	return f(resp, ctx)
+}
+
 // HandleBytes will return a RespHandler that read the entire body of the request
 // to a byte array in memory, would run the user supplied f function on the byte arra,
 // and will replace the body of the original response with the resulting byte array.
 func HandleBytes(f func(b []byte, ctx *ProxyCtx) []byte) RespHandler {
-	return FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+	return bodyHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
 		b, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			ctx.Warnf("Cannot read response %s", err)
@@ -318,3 +433,122 @@ func HandleBytes(f func(b []byte, ctx *ProxyCtx) []byte) RespHandler {
 		return resp
 	})
 }
+
+// HandleStream will return a RespHandler that transforms the response body while it is sent
+// to the client, without holding it in memory. f reads the original body from r, and writes
+// the new body to w. Whatever f writes to w is sent to the client as soon as it is written.
+// If f returns an error the client connection is aborted, so that the client would not
+// mistake the partial body for a complete one.
+func HandleStream(f func(r io.Reader, w io.Writer, ctx *ProxyCtx) error) RespHandler {
+	return bodyHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		if resp == nil || !hasBody(resp) {
+			return resp
+		}
+		body := resp.Body
+		pr, pw := io.Pipe()
+		// resp must not be modified once body is closed, as the Transport reads it then
+		resp.Body = pr
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		go func() {
+			defer func() {
+				if v := recover(); v != nil {
+					body.Close()
+					pw.CloseWithError(ctx.proxy.recovered(ctx, v))
+				}
+			}()
+			err := f(body, pw, ctx)
+			if err != nil {
+				ctx.Warnf("Cannot transform response body: %v", err)
+			}
+			body.Close()
+			pw.CloseWithError(err)
+		}()
+		return resp
+	})
+}
+
+// HandleRequestBytes will return a ReqHandler that reads the entire body of the request to
+// memory, runs f on it, and sends the resulting byte array as the request body instead.
+// Content-Length is fixed to match the new body. Requests without a body are left as is if
+// f returns an empty body.
+func HandleRequestBytes(f func(b []byte, ctx *ProxyCtx) []byte) ReqHandler {
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		var b []byte
+		hasBody := req.Body != nil && req.Body != http.NoBody
+		if hasBody {
+			var err error
+			if b, err = ioutil.ReadAll(req.Body); err != nil {
+				ctx.Warnf("Cannot read request %s", err)
+				return req, nil
+			}
+			req.Body.Close()
+		}
+		b = f(b, ctx)
+		if !hasBody && len(b) == 0 {
+			return req, nil
+		}
+		SetRequestBody(req, ioutil.NopCloser(bytes.NewReader(b)), int64(len(b)))
+		return req, nil
+	})
+}
+
+// HandleRequestStream will return a ReqHandler that transforms the request body while it is
+// sent to the destination, without holding it in memory. f reads the original body from r,
+// and writes the new body to w. The new body is sent with chunked encoding. If f returns an
+// error, sending the request fails with this error. Requests without a body are not handled.
+func HandleRequestStream(f func(r io.Reader, w io.Writer, ctx *ProxyCtx) error) ReqHandler {
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if req.Body == nil || req.Body == http.NoBody || (req.ContentLength == 0 && len(req.TransferEncoding) == 0) {
+			return req, nil
+		}
+		body := req.Body
+		pr, pw := io.Pipe()
+		go func() {
+			defer func() {
+				if v := recover(); v != nil {
+					body.Close()
+					pw.CloseWithError(ctx.proxy.recovered(ctx, v))
+				}
+			}()
+			err := f(body, pw, ctx)
+			if err != nil {
+				ctx.Warnf("Cannot transform request body: %v", err)
+			}
+			body.Close()
+			pw.CloseWithError(err)
+		}()
+		SetRequestBody(req, pr, -1)
+		return req, nil
+	})
+}
+
+// closeRequestBody closes the body of a request which is not sent, so that a handler
+// transforming it, see HandleRequestStream, is done
+func closeRequestBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// SetRequestBody replaces the body of req, and fixes the Content-Length and Transfer-Encoding
+// of the request accordingly. length is the length of the new body, or -1 if it is unknown,
+// in which case the body is sent with chunked encoding.
+func SetRequestBody(req *http.Request, body io.ReadCloser, length int64) {
+	req.Header.Del("Content-Length")
+	req.Header.Del("Transfer-Encoding")
+	req.GetBody = nil
+	if length == 0 {
+		body.Close()
+		body = http.NoBody
+		req.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+	}
+	req.Body = body
+	req.ContentLength = length
+	if length < 0 {
+		req.TransferEncoding = []string{"chunked"}
+	} else {
+		req.TransferEncoding = nil
+		req.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+}
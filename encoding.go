@@ -0,0 +1,273 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentEncoding decodes and encodes bodies of a Content-Encoding, see
+// RegisterContentEncoding
+type ContentEncoding interface {
+	NewReader(r io.Reader) (io.Reader, error)
+	NewWriter(w io.Writer) (EncodingWriter, error)
+}
+
+// EncodingWriter encodes what is written to it. Flush writes what was encoded so far, so
+// that streamed bodies are not held back.
+type EncodingWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+var contentEncodings = struct {
+	sync.RWMutex
+	// names are in order of preference
+	names []string
+	m     map[string]ContentEncoding
+}{
+	names: []string{"gzip", "deflate"},
+	m:     map[string]ContentEncoding{"gzip": gzipEncoding{}, "deflate": deflateEncoding{}},
+}
+
+// RegisterContentEncoding makes the proxy ask destination servers for the Content-Encoding
+// name, and encode responses with it for the clients which accept it. gzip and deflate are
+// supported out of the box, brotli is registered by importing ext/brotli, which depends on
+// github.com/andybalholm/brotli.
+func RegisterContentEncoding(name string, e ContentEncoding) {
+	contentEncodings.Lock()
+	defer contentEncodings.Unlock()
+	name = strings.ToLower(name)
+	if _, ok := contentEncodings.m[name]; !ok {
+		contentEncodings.names = append(contentEncodings.names, name)
+	}
+	contentEncodings.m[name] = e
+}
+
+func contentEncoding(name string) ContentEncoding {
+	contentEncodings.RLock()
+	defer contentEncodings.RUnlock()
+	return contentEncodings.m[strings.ToLower(name)]
+}
+
+type gzipEncoding struct{}
+
+func (gzipEncoding) NewReader(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+func (gzipEncoding) NewWriter(w io.Writer) (EncodingWriter, error) {
+	return gzip.NewWriter(w), nil
+}
+
+type deflateEncoding struct{}
+
+// NewReader reads zlib streams, as the deflate Content-Encoding should be, as well as raw
+// deflate streams, which some servers send instead
+func (deflateEncoding) NewReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if h, err := br.Peek(2); err == nil && h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+func (deflateEncoding) NewWriter(w io.Writer) (EncodingWriter, error) {
+	return zlib.NewWriter(w), nil
+}
+
+// negotiateEncoding asks the destination server of req for the encodings the proxy can
+// decode, rather than those the client accepts, which are kept in ctx to encode the
+// response. Range requests are left alone, since ranges apply to the encoded body, and so
+// are the requests when no handler is marked as reading the body, see Handle.ReadsBodies.
+func negotiateEncoding(req *http.Request, ctx *ProxyCtx) {
+	ctx.clientEncodings, ctx.negotiated = req.Header.Get("Accept-Encoding"), false
+	if req.Header.Get("Range") != "" || isUpgradeRequest(req) || !ctx.proxy.handlers.load().readsBodies {
+		return
+	}
+	contentEncodings.RLock()
+	req.Header.Set("Accept-Encoding", strings.Join(contentEncodings.names, ", "))
+	contentEncodings.RUnlock()
+	ctx.negotiated = true
+}
+
+// decodeResponse makes the body of resp, received from the destination server, decoded
+// when it is read, so that handlers see the decoded body. The body is only decoded if
+// read, see encodeResponse.
+func decodeResponse(resp *http.Response, ctx *ProxyCtx) {
+	name := resp.Header.Get("Content-Encoding")
+	if !ctx.negotiated || name == "" || !hasBody(resp) || resp.StatusCode == http.StatusPartialContent {
+		return
+	}
+	e := contentEncoding(name)
+	if e == nil {
+		return
+	}
+	resp.Body = &decodedBody{raw: resp.Body, e: e, name: name, length: resp.ContentLength}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+}
+
+// encodeResponse encodes the body of resp, before it is written to the client, with the
+// best encoding the client accepts, if it was decoded by decodeResponse. If origBody, the
+// body of the response received from the destination server, was not touched by the
+// handlers, it is sent as received if the client accepts its encoding. It reports whether
+// the body sent differs from the one received.
+func encodeResponse(resp *http.Response, origBody io.ReadCloser, ctx *ProxyCtx) bool {
+	decoded, ok := origBody.(*decodedBody)
+	if !ok {
+		return resp.Body != origBody
+	}
+	if resp.Header.Get("Content-Encoding") != "" {
+		// a handler encoded the body itself
+		return true
+	}
+	if resp.Body == decoded && !decoded.started.Load() && acceptsEncoding(ctx.clientEncodings, decoded.name) {
+		resp.Body = decoded.raw
+		resp.Header.Set("Content-Encoding", decoded.name)
+		resp.ContentLength = decoded.length
+		if decoded.length >= 0 {
+			resp.Header.Set("Content-Length", strconv.FormatInt(decoded.length, 10))
+		}
+		resp.Uncompressed = false
+		return false
+	}
+	if name := preferredEncoding(ctx.clientEncodings); name != "" {
+		w := &encodedBody{src: resp.Body}
+		var err error
+		if w.w, err = contentEncoding(name).NewWriter(&w.buf); err != nil {
+			ctx.Warnf("Cannot encode response with %v: %v", name, err)
+			return true
+		}
+		resp.Body = w
+		resp.Header.Set("Content-Encoding", name)
+		if !headerHasToken(resp.Header, "Vary", "Accept-Encoding") {
+			resp.Header.Add("Vary", "Accept-Encoding")
+		}
+		resp.ContentLength = -1
+		resp.Uncompressed = false
+	}
+	return true
+}
+
+// acceptedEncodings parses an Accept-Encoding header into the quality of each encoding
+func acceptedEncodings(accept string) map[string]float64 {
+	q := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name == "" {
+			continue
+		}
+		q[name] = 1
+		for _, p := range params[1:] {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q[name] = v
+				}
+			}
+		}
+	}
+	return q
+}
+
+func encodingQuality(accepted map[string]float64, name string) float64 {
+	if q, ok := accepted[strings.ToLower(name)]; ok {
+		return q
+	}
+	return accepted["*"]
+}
+
+func acceptsEncoding(accept, name string) bool {
+	return encodingQuality(acceptedEncodings(accept), name) > 0
+}
+
+// preferredEncoding returns the encoding to encode a response with, among those the client
+// accepts, or "" if the response should not be encoded
+func preferredEncoding(accept string) string {
+	accepted := acceptedEncodings(accept)
+	contentEncodings.RLock()
+	defer contentEncodings.RUnlock()
+	best, bestQ := "", 0.0
+	for _, name := range contentEncodings.names {
+		if q := encodingQuality(accepted, name); q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// decodedBody is a body decoded as it is read
+type decodedBody struct {
+	raw     io.ReadCloser
+	e       ContentEncoding
+	name    string
+	length  int64
+	started atomic.Bool
+	r       io.Reader
+	err     error
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	if !b.started.Load() {
+		b.started.Store(true)
+		b.r, b.err = b.e.NewReader(b.raw)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.r.Read(p)
+}
+
+func (b *decodedBody) Close() error {
+	if c, ok := b.r.(io.Closer); ok {
+		c.Close()
+	}
+	return b.raw.Close()
+}
+
+// encodedBody is a body encoded as it is read. What was read from src is flushed on every
+// read, so that streamed bodies are not held back.
+type encodedBody struct {
+	src io.ReadCloser
+	w   EncodingWriter
+	buf bytes.Buffer
+	eof bool
+	tmp [32 * 1024]byte
+}
+
+func (b *encodedBody) Read(p []byte) (int, error) {
+	for b.buf.Len() == 0 && !b.eof {
+		n, err := b.src.Read(b.tmp[:])
+		if n > 0 {
+			b.w.Write(b.tmp[:n])
+		}
+		switch {
+		case err == io.EOF:
+			b.eof = true
+			b.w.Close()
+		case err != nil:
+			return 0, err
+		case n > 0:
+			b.w.Flush()
+		}
+	}
+	if b.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return b.buf.Read(p)
+}
+
+func (b *encodedBody) Close() error {
+	return b.src.Close()
+}
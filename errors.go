@@ -0,0 +1,184 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// ErrorKind tells why the proxy failed to serve a request, see ProxyError
+type ErrorKind int
+
+const (
+	// ErrorUpstream is any other failure to get a response from the destination server,
+	// such as a connection reset or a malformed response
+	ErrorUpstream ErrorKind = iota
+	// ErrorDial is a failure to connect to the destination server
+	ErrorDial
+	// ErrorDNS is a failure to resolve the name of the destination server
+	ErrorDNS
+	// ErrorUpstreamTLS is a failure of the TLS handshake with the destination server, for
+	// example because its certificate is invalid
+	ErrorUpstreamTLS
+	// ErrorTimeout is a phase of proxying taking too long, see Timeouts
+	ErrorTimeout
+	// ErrorHandlerPanic is a handler panicking
+	ErrorHandlerPanic
+	// ErrorBodyTooLarge is a body exceeding a limit, such as http.MaxBytesReader's
+	ErrorBodyTooLarge
+	// ErrorBadRequest is a request the proxy can't make sense of
+	ErrorBadRequest
+	// ErrorProxy is a failure of the proxy itself, such as failing to sign a certificate
+	ErrorProxy
+	// ErrorLoop is a request looping back to the proxy, see ErrLoopDetected
+	ErrorLoop
+	// ErrorNoEndpoint is a request sent to a Pool without healthy endpoints, see
+	// ErrNoEndpoint
+	ErrorNoEndpoint
+	// ErrorCircuitOpen is a request failed fast by an open circuit breaker, see Breakers
+	ErrorCircuitOpen
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorUpstream:
+		return "upstream error"
+	case ErrorDial:
+		return "dial error"
+	case ErrorDNS:
+		return "DNS error"
+	case ErrorUpstreamTLS:
+		return "upstream TLS error"
+	case ErrorTimeout:
+		return "timeout"
+	case ErrorHandlerPanic:
+		return "handler panic"
+	case ErrorBodyTooLarge:
+		return "body too large"
+	case ErrorBadRequest:
+		return "bad request"
+	case ErrorProxy:
+		return "proxy error"
+	case ErrorLoop:
+		return "loop detected"
+	case ErrorNoEndpoint:
+		return "no endpoint"
+	case ErrorCircuitOpen:
+		return "circuit open"
+	}
+	return "unknown error"
+}
+
+// StatusCode returns the status of the response sent to the client on an error of kind k
+func (k ErrorKind) StatusCode() int {
+	switch k {
+	case ErrorTimeout:
+		return http.StatusGatewayTimeout
+	case ErrorHandlerPanic, ErrorProxy:
+		return http.StatusInternalServerError
+	case ErrorBodyTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ErrorBadRequest:
+		return http.StatusBadRequest
+	case ErrorLoop:
+		return http.StatusLoopDetected
+	case ErrorNoEndpoint, ErrorCircuitOpen:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// ProxyError is set in ctx.Error when the proxy fails to serve a request. Its Kind tells
+// apart the destination being unreachable from the proxy failing, and the underlying
+// error, such as a *net.DNSError or a *TimeoutError, can be retrieved with errors.As.
+type ProxyError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// StatusCode returns the status of the response sent to the client on e
+func (e *ProxyError) StatusCode() int {
+	return e.Kind.StatusCode()
+}
+
+// newProxyError returns err as a *ProxyError. Its kind is guessed from err, or is kind
+// if it can't be.
+func newProxyError(kind ErrorKind, err error) *ProxyError {
+	var perr *ProxyError
+	if errors.As(err, &perr) {
+		return perr
+	}
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	var maxErr *http.MaxBytesError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var certErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &dnsErr):
+		kind = ErrorDNS
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		kind = ErrorTimeout
+	case errors.As(err, &maxErr):
+		kind = ErrorBodyTooLarge
+	case errors.As(err, &certErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) || errors.As(err, &recordErr) || errors.As(err, &alertErr):
+		kind = ErrorUpstreamTLS
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		kind = ErrorDial
+	}
+	return &ProxyError{kind, err}
+}
+
+// failedResponse sets err, the reason why req could not be sent, in ctx.Error, and returns
+// the response sent to the client instead: the one returned by the RespHandlers if any,
+// the error response otherwise.
+func (proxy *ProxyHttpServer) failedResponse(req *http.Request, ctx *ProxyCtx, err error) *http.Response {
+	ctx.Error = newProxyError(ErrorUpstream, err)
+	if resp := proxy.filterResponse(nil, ctx); resp != nil {
+		return resp
+	}
+	return proxy.errorResponse(req, ctx)
+}
+
+// errorResponse returns the response sent to the client which sent req, when the proxy
+// failed with ctx.Error. It is rendered by ErrorHandler if set.
+func (proxy *ProxyHttpServer) errorResponse(req *http.Request, ctx *ProxyCtx) *http.Response {
+	perr := newProxyError(ErrorProxy, ctx.Error)
+	ctx.Error = perr
+	if proxy.ErrorHandler != nil {
+		if resp := proxy.ErrorHandler(req, ctx, perr); resp != nil {
+			return resp
+		}
+	}
+	return NewResponse(req, ContentTypeText, perr.StatusCode(), perr.Error()+"\n")
+}
+
+// respondError sets err in ctx.Error, and responds to r with the error response through w
+func (proxy *ProxyHttpServer) respondError(w http.ResponseWriter, r *http.Request, ctx *ProxyCtx, kind ErrorKind, err error) {
+	ctx.Error = newProxyError(kind, err)
+	resp := proxy.errorResponse(r, ctx)
+	defer resp.Body.Close()
+	copyHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		ctx.Warnf("Error responding to client: %s", err)
+	}
+}
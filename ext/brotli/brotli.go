@@ -0,0 +1,29 @@
+// Package brotli makes the proxy decode and encode bodies with the br Content-Encoding.
+// Import it for its side effect:
+//	import _ "github.com/marbemac/goproxy/ext/brotli"
+//
+// Unlike the goproxy package, it depends on a third-party module, which the programs
+// importing it must require:
+//	go get github.com/andybalholm/brotli
+package brotli
+
+import (
+	"io"
+
+	"github.com/andybalholm/brotli"
+	"github.com/marbemac/goproxy"
+)
+
+type encoding struct{}
+
+func (encoding) NewReader(r io.Reader) (io.Reader, error) {
+	return brotli.NewReader(r), nil
+}
+
+func (encoding) NewWriter(w io.Writer) (goproxy.EncodingWriter, error) {
+	return brotli.NewWriter(w), nil
+}
+
+func init() {
+	goproxy.RegisterContentEncoding("br", encoding{})
+}
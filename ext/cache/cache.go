@@ -0,0 +1,614 @@
+// Package cache caches the responses going through the proxy, as a shared cache following
+// RFC 7234: it honors Cache-Control, Expires and Vary, revalidates stale responses with
+// their ETag and Last-Modified, and supports the stale-while-revalidate and stale-if-error
+// extensions of RFC 5861. It is a RoundTripHandler, so it caches the requests sent to the
+// proxy as well as those of man in the middle'd connections, and the RespHandlers see the
+// cached responses as if they came from the destination server.
+//	c := cache.New(cache.NewMemoryStore(512 << 20))
+//	c.ForceCache(24*time.Hour, goproxy.UrlHasPrefix("artifacts.example.com/releases/"))
+//	c.Bypass(goproxy.ReqHostIs("internal.example.com"))
+//	proxy.OnRequest().DoRoundTrip(c)
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marbemac/goproxy"
+)
+
+// heuristicStatuses are the statuses which can be cached without explicit freshness, as
+// listed by RFC 7231 section 6.1
+var heuristicStatuses = map[int]bool{200: true, 203: true, 204: true, 300: true, 301: true,
+	404: true, 405: true, 410: true, 414: true, 501: true}
+
+// maxHeuristic caps the freshness guessed from Last-Modified
+const maxHeuristic = 24 * time.Hour
+
+// conditionalHeaders are the request headers making a request conditional
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since",
+	"If-Range"}
+
+type rule struct {
+	conds  []goproxy.ReqCondition
+	force  time.Duration
+	bypass bool
+}
+
+// Cache is a RoundTripHandler serving the requests from its Store when it can
+type Cache struct {
+	store        Store
+	mu           sync.Mutex
+	rules        []rule
+	revalidating map[string]bool
+	// variants serializes the changes to the entries listing the variants of a URL
+	variants sync.Mutex
+}
+
+// New returns a cache of the responses kept in store
+func New(store Store) *Cache {
+	return &Cache{store: store, revalidating: map[string]bool{}}
+}
+
+// ForceCache caches the 200 responses to the GET requests meeting conds for ttl, whatever
+// the requests and the responses say, and serves them stale if the destination server
+// fails afterwards. Rules are matched in the order they were added.
+func (c *Cache) ForceCache(ttl time.Duration, conds ...goproxy.ReqCondition) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rules = append(c.rules, rule{conds: conds, force: ttl})
+}
+
+// Bypass sends the requests meeting conds as is, without caching them. Rules are matched in
+// the order they were added.
+func (c *Cache) Bypass(conds ...goproxy.ReqCondition) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rules = append(c.rules, rule{conds: conds, bypass: true})
+}
+
+func (c *Cache) match(req *http.Request, ctx *goproxy.ProxyCtx) *rule {
+	c.mu.Lock()
+	rules := c.rules
+	c.mu.Unlock()
+outer:
+	for i := range rules {
+		for _, cond := range rules[i].conds {
+			if !cond.HandleReq(req, ctx) {
+				continue outer
+			}
+		}
+		return &rules[i]
+	}
+	return nil
+}
+
+// directives are the directives of a Cache-Control header, by lower case name
+type directives map[string]string
+
+func cacheControl(h http.Header) directives {
+	d := directives{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name != "" {
+				d[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return d
+}
+
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// seconds returns the duration of the directive name, if it has a valid one
+func (d directives) seconds(name string) (time.Duration, bool) {
+	v, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	s, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || s < 0 {
+		return 0, false
+	}
+	return time.Duration(s) * time.Second, true
+}
+
+// key returns the key of the responses to req, which are the responses to GET requests
+// for its URL
+func key(req *http.Request) string {
+	u := *req.URL
+	u.Fragment = ""
+	return u.String()
+}
+
+// variantKey returns the key of the responses to req varying by the request headers names
+func variantKey(key string, names []string, req *http.Request) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range names {
+		fmt.Fprintf(&b, "\n%v: %v", name, strings.Join(req.Header.Values(name), ", "))
+	}
+	return b.String()
+}
+
+// varyNames returns the request header names of the Vary of h, or false if it is "*"
+func varyNames(h http.Header) ([]string, bool) {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name == "*" {
+				return nil, false
+			} else if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names, true
+}
+
+// date returns the Date of the response of e, or when it was received
+func date(e *Entry) time.Time {
+	if t, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return t
+	}
+	return e.ResponseTime
+}
+
+// lifetime returns how long the response of e is fresh for, as given by its headers, or by
+// force if it is set
+func lifetime(e *Entry, force time.Duration) time.Duration {
+	if force > 0 {
+		return force
+	}
+	cc := cacheControl(e.Header)
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(date(e))
+	}
+	if lm, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && heuristicStatuses[e.StatusCode] {
+		if d := date(e).Sub(lm) / 10; d < maxHeuristic {
+			return d
+		}
+		return maxHeuristic
+	}
+	return 0
+}
+
+// age returns the age of the response of e at now, RFC 7234 section 4.2.3
+func age(e *Entry, now time.Time) time.Duration {
+	apparent := e.ResponseTime.Sub(date(e))
+	if apparent < 0 {
+		apparent = 0
+	}
+	var ageValue time.Duration
+	if s, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && s > 0 {
+		ageValue = time.Duration(s) * time.Second
+	}
+	corrected := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	if corrected < apparent {
+		corrected = apparent
+	}
+	return corrected + now.Sub(e.ResponseTime)
+}
+
+// storable reports whether resp, the response to req, can be stored
+func storable(req *http.Request, resp *http.Response, force time.Duration) bool {
+	if req.Method != "GET" {
+		return false
+	}
+	if _, ok := varyNames(resp.Header); !ok {
+		return false
+	}
+	switch {
+	case resp.StatusCode < 200, resp.StatusCode == http.StatusPartialContent, resp.StatusCode == http.StatusNotModified:
+		return false
+	}
+	if force > 0 {
+		return resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNonAuthoritativeInfo
+	}
+	cc := cacheControl(resp.Header)
+	if cacheControl(req.Header).has("no-store") || cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("must-revalidate") &&
+		!cc.has("s-maxage") {
+		return false
+	}
+	explicit := cc.has("s-maxage") || cc.has("max-age") || cc.has("public") || resp.Header.Get("Expires") != ""
+	if !heuristicStatuses[resp.StatusCode] && !explicit {
+		return false
+	}
+	// responses which are stale right away are only worth storing if they can be
+	// revalidated
+	e := &Entry{StatusCode: resp.StatusCode, Header: resp.Header, ResponseTime: time.Now()}
+	return lifetime(e, 0) > 0 || resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// mustRevalidate reports whether the response of e can't be served stale
+func mustRevalidate(cc directives) bool {
+	return cc.has("must-revalidate") || cc.has("proxy-revalidate") || cc.has("s-maxage")
+}
+
+func (c *Cache) HandleRoundTrip(req *http.Request, ctx *goproxy.ProxyCtx, next goproxy.RoundTripper) (*http.Response, error) {
+	var force time.Duration
+	if r := c.match(req, ctx); r != nil && r.bypass {
+		return next.RoundTrip(req, ctx)
+	} else if r != nil {
+		force = r.force
+	}
+	switch req.Method {
+	case "GET", "HEAD":
+	case "OPTIONS", "TRACE":
+		return next.RoundTrip(req, ctx)
+	default:
+		// unsafe methods invalidate the responses of their URL
+		resp, err := next.RoundTrip(req, ctx)
+		if err == nil && resp.StatusCode < 400 {
+			c.invalidate(key(req))
+		}
+		return resp, err
+	}
+	reqCC := cacheControl(req.Header)
+	if req.Header.Get("Range") != "" || (reqCC.has("no-store") && force == 0) {
+		return next.RoundTrip(req, ctx)
+	}
+	k := key(req)
+	e, body, vkey := c.lookup(k, req)
+	if e == nil {
+		if reqCC.has("only-if-cached") {
+			return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusGatewayTimeout, "not cached\n"), nil
+		}
+		return c.fetch(req, ctx, next, k, force)
+	}
+
+	now := time.Now()
+	respCC := cacheControl(e.Header)
+	current, fresh := age(e, now), lifetime(e, force)
+	staleness := current - fresh
+	noCache := force == 0 && (respCC.has("no-cache") || reqCC.has("no-cache") ||
+		(len(req.Header.Values("Cache-Control")) == 0 && strings.Contains(req.Header.Get("Pragma"), "no-cache")))
+	if force == 0 {
+		if d, ok := reqCC.seconds("max-age"); ok && current > d {
+			noCache = true
+		}
+		if d, ok := reqCC.seconds("min-fresh"); ok && fresh-current < d {
+			staleness = d - (fresh - current)
+		}
+	}
+	if !noCache && staleness < 0 {
+		return serve(req, e, body, now, ""), nil
+	}
+	if !noCache && !mustRevalidate(respCC) && reqCC.has("max-stale") {
+		if d, ok := reqCC.seconds("max-stale"); !ok || staleness <= d {
+			return serve(req, e, body, now, `110 - "Response is Stale"`), nil
+		}
+	}
+	if reqCC.has("only-if-cached") {
+		body.Close()
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusGatewayTimeout, "not cached\n"), nil
+	}
+	if d, ok := respCC.seconds("stale-while-revalidate"); ok && !noCache && !mustRevalidate(respCC) && staleness <= d {
+		c.revalidateInBackground(req, ctx, next, k, vkey, e, force)
+		return serve(req, e, body, now, `110 - "Response is Stale"`), nil
+	}
+
+	resp, requestTime, err := c.validate(req, ctx, next, vkey, e)
+	if (err != nil || resp.StatusCode >= 500) && c.staleIfError(reqCC, respCC, staleness, force) {
+		if err == nil {
+			resp.Body.Close()
+		}
+		ctx.Warnf("Serving stale %v, failed to revalidate it", k)
+		return serve(req, e, body, time.Now(), `111 - "Revalidation Failed"`), nil
+	}
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return serve(req, e, body, time.Now(), ""), nil
+	}
+	body.Close()
+	return c.keep(req, ctx, resp, k, requestTime, force), nil
+}
+
+// lookup returns the stored response to req, whose key is k, and the key of its variant
+func (c *Cache) lookup(k string, req *http.Request) (*Entry, io.ReadCloser, string) {
+	e, body, err := c.store.Get(k)
+	if err != nil {
+		return nil, nil, ""
+	}
+	if e.Variants == nil {
+		return e, body, k
+	}
+	body.Close()
+	vkey := variantKey(k, e.Variants, req)
+	if e, body, err = c.store.Get(vkey); err != nil {
+		return nil, nil, ""
+	}
+	return e, body, vkey
+}
+
+// staleIfError reports whether a response of staleness can be served when it can't be
+// revalidated
+func (c *Cache) staleIfError(reqCC, respCC directives, staleness, force time.Duration) bool {
+	if force > 0 {
+		return true
+	}
+	if mustRevalidate(respCC) {
+		return false
+	}
+	for _, cc := range []directives{reqCC, respCC} {
+		if d, ok := cc.seconds("stale-if-error"); ok && staleness <= d {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch sends req, whose response has the key k and is not stored, storing its response
+func (c *Cache) fetch(req *http.Request, ctx *goproxy.ProxyCtx, next goproxy.RoundTripper, k string, force time.Duration) (*http.Response, error) {
+	requestTime := time.Now()
+	resp, err := next.RoundTrip(req, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.keep(req, ctx, resp, k, requestTime, force), nil
+}
+
+// validate sends req conditionally on the response of e, stored under vkey. If it is not
+// modified, e is updated with the headers of the 304 response.
+func (c *Cache) validate(req *http.Request, ctx *goproxy.ProxyCtx, next goproxy.RoundTripper, vkey string, e *Entry) (*http.Response, time.Time, error) {
+	creq := req.Clone(req.Context())
+	// the conditions of the client are checked against the response of the cache instead
+	for _, h := range conditionalHeaders {
+		creq.Header.Del(h)
+	}
+	if etag := e.Header.Get("ETag"); etag != "" {
+		creq.Header.Set("If-None-Match", etag)
+	}
+	if lm := e.Header.Get("Last-Modified"); lm != "" {
+		creq.Header.Set("If-Modified-Since", lm)
+	}
+	requestTime := time.Now()
+	resp, err := next.RoundTrip(creq, ctx)
+	if err != nil || resp.StatusCode != http.StatusNotModified {
+		return resp, requestTime, err
+	}
+	resp.Body.Close()
+	for name, values := range resp.Header {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Content-Range", "Set-Cookie":
+		default:
+			e.Header[name] = values
+		}
+	}
+	e.RequestTime, e.ResponseTime = requestTime, time.Now()
+	if err := c.store.Update(vkey, e); err != nil && !errors.Is(err, ErrNotFound) {
+		ctx.Warnf("Cannot update cached %v: %v", vkey, err)
+	}
+	return resp, requestTime, nil
+}
+
+// revalidateInBackground revalidates the response of e, stored under vkey, unless it is
+// being revalidated already
+func (c *Cache) revalidateInBackground(req *http.Request, ctx *goproxy.ProxyCtx, next goproxy.RoundTripper, k, vkey string, e *Entry, force time.Duration) {
+	c.mu.Lock()
+	if c.revalidating[vkey] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[vkey] = true
+	c.mu.Unlock()
+	// the request outlives the client request, and ctx, which is reused for the next
+	// requests of a man in the middle'd connection
+	breq := req.Clone(context.WithoutCancel(req.Context()))
+	bctx := *ctx
+	bctx.Attempts = nil
+	e = e.clone()
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.revalidating, vkey)
+			c.mu.Unlock()
+		}()
+		resp, requestTime, err := c.validate(breq, &bctx, next, vkey, e)
+		if err != nil {
+			bctx.Warnf("Cannot revalidate %v: %v", k, err)
+			return
+		}
+		if resp.StatusCode == http.StatusNotModified {
+			return
+		}
+		resp = c.keep(breq, &bctx, resp, k, requestTime, force)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// keep stores resp, the response to req received from the destination server, under k
+// or the key of its variant, as its body is read. It returns the response to send.
+func (c *Cache) keep(req *http.Request, ctx *goproxy.ProxyCtx, resp *http.Response, k string, requestTime time.Time, force time.Duration) *http.Response {
+	if !storable(req, resp, force) {
+		if req.Method == "GET" && resp.StatusCode != http.StatusNotModified {
+			// the response replaces the stored one
+			c.invalidate(k)
+		}
+		return resp
+	}
+	names, _ := varyNames(resp.Header)
+	e := &Entry{StatusCode: resp.StatusCode, Header: resp.Header.Clone(), RequestTime: requestTime,
+		ResponseTime: time.Now()}
+	// the cookies of a client are not given to the others
+	e.Header.Del("Set-Cookie")
+	skey := k
+	if len(names) > 0 {
+		skey = variantKey(k, names, req)
+		if err := c.addVariant(k, names, skey); err != nil {
+			ctx.Warnf("Cannot cache %v: %v", k, err)
+			return resp
+		}
+	}
+	w, err := c.store.Put(skey, e)
+	if err != nil {
+		ctx.Warnf("Cannot cache %v: %v", k, err)
+		return resp
+	}
+	resp.Body = &fillBody{ReadCloser: resp.Body, w: w, key: skey, ctx: ctx}
+	return resp
+}
+
+// addVariant lists skey in the entry of k, as the key of a response varying by names. The
+// variants varying by other names are removed.
+func (c *Cache) addVariant(k string, names []string, skey string) error {
+	c.variants.Lock()
+	defer c.variants.Unlock()
+	index := &Entry{Key: k, Variants: names}
+	if old, body, err := c.store.Get(k); err == nil {
+		body.Close()
+		if strings.Join(old.Variants, ",") == strings.Join(names, ",") {
+			index.VariantKeys = old.VariantKeys
+		} else {
+			for _, vkey := range old.VariantKeys {
+				c.store.Delete(vkey)
+			}
+		}
+	}
+	for _, vkey := range index.VariantKeys {
+		if vkey == skey {
+			return nil
+		}
+	}
+	index.VariantKeys = append(index.VariantKeys, skey)
+	w, err := c.store.Put(k, index)
+	if err != nil {
+		return err
+	}
+	return w.Commit()
+}
+
+// invalidate removes the response stored under k, or its variants
+func (c *Cache) invalidate(k string) {
+	c.variants.Lock()
+	defer c.variants.Unlock()
+	if e, body, err := c.store.Get(k); err == nil {
+		body.Close()
+		for _, vkey := range e.VariantKeys {
+			c.store.Delete(vkey)
+		}
+	}
+	c.store.Delete(k)
+}
+
+// fillBody writes the body of a response to the store as it is read, committing it once it
+// is read entirely
+type fillBody struct {
+	io.ReadCloser
+	w   EntryWriter
+	key string
+	ctx *goproxy.ProxyCtx
+}
+
+func (b *fillBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.w == nil {
+		return n, err
+	}
+	if n > 0 {
+		if _, werr := b.w.Write(p[:n]); werr != nil {
+			b.ctx.Logf("Not caching %v: %v", b.key, werr)
+			b.w.Abort()
+			b.w = nil
+			return n, err
+		}
+	}
+	if err == io.EOF {
+		if cerr := b.w.Commit(); cerr != nil {
+			b.ctx.Warnf("Cannot cache %v: %v", b.key, cerr)
+		}
+		b.w = nil
+	} else if err != nil {
+		b.w.Abort()
+		b.w = nil
+	}
+	return n, err
+}
+
+func (b *fillBody) Close() error {
+	if b.w != nil {
+		b.w.Abort()
+		b.w = nil
+	}
+	return b.ReadCloser.Close()
+}
+
+// notModified reports whether the conditions of req hold for the response of e, RFC 7232
+// section 6
+func notModified(req *http.Request, e *Entry) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			if tag = strings.TrimSpace(tag); tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// serve returns the stored response of e, whose body is body, as the response to req
+func serve(req *http.Request, e *Entry, body io.ReadCloser, now time.Time, warning string) *http.Response {
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.Header.Clone(),
+		Body:          body,
+		ContentLength: e.Size,
+		Request:       req,
+	}
+	resp.Header.Set("Age", strconv.FormatInt(int64(age(e, now)/time.Second), 10))
+	if warning != "" {
+		resp.Header.Add("Warning", warning)
+	}
+	if e.StatusCode == http.StatusOK && notModified(req, e) {
+		body.Close()
+		resp.Status, resp.StatusCode = "304 Not Modified", http.StatusNotModified
+		resp.Body, resp.ContentLength = http.NoBody, 0
+		resp.Header.Del("Content-Length")
+	} else if req.Method == "HEAD" {
+		body.Close()
+		resp.Body = http.NoBody
+	}
+	return resp
+}
@@ -0,0 +1,319 @@
+package cache_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marbemac/goproxy"
+	"github.com/marbemac/goproxy/ext/cache"
+)
+
+func oneShotProxy(proxy *goproxy.ProxyHttpServer) (client *http.Client, s *httptest.Server) {
+	s = httptest.NewServer(proxy)
+
+	proxyUrl, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyUrl), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	client = &http.Client{Transport: tr}
+	return
+}
+
+// origin is a destination server answering with the headers and body set for each path,
+// and counting the requests it gets
+type origin struct {
+	mu       sync.Mutex
+	headers  map[string]http.Header
+	bodies   map[string]string
+	status   map[string]int
+	requests map[string][]*http.Request
+}
+
+func newOrigin() *origin {
+	return &origin{headers: map[string]http.Header{}, bodies: map[string]string{}, status: map[string]int{},
+		requests: map[string][]*http.Request{}}
+}
+
+func (o *origin) set(path string, status int, body string, header ...string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	h := http.Header{}
+	for i := 0; i < len(header); i += 2 {
+		h.Add(header[i], header[i+1])
+	}
+	o.headers[path], o.bodies[path], o.status[path] = h, body, status
+}
+
+func (o *origin) count(path string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.requests[path])
+}
+
+func (o *origin) last(path string) *http.Request {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.requests[path][len(o.requests[path])-1]
+}
+
+func (o *origin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	o.requests[r.URL.Path] = append(o.requests[r.URL.Path], r)
+	h, body, status := o.headers[r.URL.Path], o.bodies[r.URL.Path], o.status[r.URL.Path]
+	o.mu.Unlock()
+	for name, values := range h {
+		w.Header()[name] = values
+	}
+	if etag := h.Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(status)
+	io.WriteString(w, strings.ReplaceAll(body, "$lang", r.Header.Get("X-Lang")))
+}
+
+func get(client *http.Client, u string, t *testing.T, header ...string) (*http.Response, string) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+func TestCaching(t *testing.T) {
+	o := newOrigin()
+	o.set("/fresh", 200, "fresh", "Cache-Control", "max-age=60", "ETag", `"v1"`)
+	o.set("/private", 200, "private", "Cache-Control", "private, max-age=60")
+	o.set("/vary", 200, "hello $lang", "Cache-Control", "max-age=60", "Vary", "X-Lang")
+	background := httptest.NewServer(o)
+	defer background.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoRoundTrip(cache.New(cache.NewMemoryStore(1 << 20)))
+	client, proxyserver := oneShotProxy(proxy)
+	defer proxyserver.Close()
+
+	for i := 0; i < 3; i++ {
+		if resp, b := get(client, background.URL+"/fresh", t); resp.StatusCode != 200 || b != "fresh" {
+			t.Error("Unexpected response", resp.Status, b)
+		}
+	}
+	if n := o.count("/fresh"); n != 1 {
+		t.Error("Expected fresh responses to be served from the cache, origin got", n, "requests")
+	}
+	if resp, b := get(client, background.URL+"/fresh", t, "Cache-Control", "no-cache"); b != "fresh" ||
+		o.count("/fresh") != 2 || o.last("/fresh").Header.Get("If-None-Match") != `"v1"` || resp.StatusCode != 200 {
+		t.Error("Expected no-cache to revalidate the response, got", resp.Status, b)
+	}
+	if resp, _ := get(client, background.URL+"/fresh", t, "If-None-Match", `"v1"`); resp.StatusCode != 304 ||
+		o.count("/fresh") != 2 {
+		t.Error("Expected the cache to answer conditional requests, got", resp.Status)
+	}
+
+	get(client, background.URL+"/private", t)
+	get(client, background.URL+"/private", t)
+	if n := o.count("/private"); n != 2 {
+		t.Error("Expected private responses not to be cached, origin got", n, "requests")
+	}
+
+	for i := 0; i < 2; i++ {
+		for _, lang := range []string{"en", "fr"} {
+			if _, b := get(client, background.URL+"/vary", t, "X-Lang", lang); b != "hello "+lang {
+				t.Error("Expected the variant of", lang, "got", b)
+			}
+		}
+	}
+	if n := o.count("/vary"); n != 2 {
+		t.Error("Expected each variant to be cached, origin got", n, "requests")
+	}
+
+	// POST invalidates every variant
+	resp, err := client.Post(background.URL+"/vary", "text/plain", strings.NewReader("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	o.set("/vary", 200, "bonjour $lang", "Cache-Control", "max-age=60", "Vary", "X-Lang")
+	for _, lang := range []string{"en", "fr"} {
+		if _, b := get(client, background.URL+"/vary", t, "X-Lang", lang); b != "bonjour "+lang {
+			t.Error("Expected the variant of", lang, "to be fetched again after POST, got", b)
+		}
+	}
+}
+
+func TestStale(t *testing.T) {
+	o := newOrigin()
+	// responses older than their max-age are stale right away
+	o.set("/swr", 200, "v1", "Cache-Control", "max-age=10, stale-while-revalidate=60", "Age", "20")
+	o.set("/sie", 200, "v1", "Cache-Control", "max-age=10, stale-if-error=60", "Age", "20")
+	o.set("/revalidate", 200, "v1", "Cache-Control", "max-age=10, must-revalidate, stale-if-error=60", "Age", "20")
+	background := httptest.NewServer(o)
+	defer background.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoRoundTrip(cache.New(cache.NewMemoryStore(1 << 20)))
+	client, proxyserver := oneShotProxy(proxy)
+	defer proxyserver.Close()
+
+	get(client, background.URL+"/swr", t)
+	o.set("/swr", 200, "v2", "Cache-Control", "max-age=10, stale-while-revalidate=60", "Age", "20")
+	if resp, b := get(client, background.URL+"/swr", t); b != "v1" || !strings.HasPrefix(resp.Header.Get("Warning"), "110") {
+		t.Error("Expected the stale response while revalidating, got", b, resp.Header.Get("Warning"))
+	}
+	b := ""
+	for deadline := time.Now().Add(time.Second); b != "v2" && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		_, b = get(client, background.URL+"/swr", t)
+	}
+	if b != "v2" {
+		t.Error("Expected the response to be revalidated in the background")
+	}
+
+	get(client, background.URL+"/sie", t)
+	o.set("/sie", 503, "down")
+	if resp, b := get(client, background.URL+"/sie", t); resp.StatusCode != 200 || b != "v1" ||
+		!strings.HasPrefix(resp.Header.Get("Warning"), "111") {
+		t.Error("Expected the stale response when the server fails, got", resp.Status, b)
+	}
+	get(client, background.URL+"/revalidate", t)
+	o.set("/revalidate", 503, "down")
+	if resp, _ := get(client, background.URL+"/revalidate", t); resp.StatusCode != 503 {
+		t.Error("must-revalidate responses should not be served stale, got", resp.Status)
+	}
+}
+
+func TestForceAndBypass(t *testing.T) {
+	o := newOrigin()
+	o.set("/artifacts/a.tgz", 200, "artifact", "Cache-Control", "no-store")
+	o.set("/live", 200, "live", "Cache-Control", "max-age=60")
+	o.set("/artifacts/session", 200, "artifact", "Set-Cookie", "session=alice")
+	background := httptest.NewServer(o)
+	defer background.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	c := cache.New(cache.NewMemoryStore(1 << 20))
+	c.ForceCache(time.Hour, goproxy.UrlHasPrefix("/artifacts/"))
+	c.Bypass(goproxy.UrlHasPrefix("/live"))
+	proxy.OnRequest().DoRoundTrip(c)
+	client, proxyserver := oneShotProxy(proxy)
+	defer proxyserver.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, b := get(client, background.URL+"/artifacts/a.tgz", t, "Cache-Control", "no-cache"); b != "artifact" {
+			t.Error("Unexpected body", b)
+		}
+		get(client, background.URL+"/live", t)
+	}
+	if n := o.count("/artifacts/a.tgz"); n != 1 {
+		t.Error("Expected the forced response to be cached, origin got", n, "requests")
+	}
+	if n := o.count("/live"); n != 3 {
+		t.Error("Expected the bypassed requests not to be cached, origin got", n, "requests")
+	}
+	if resp, _ := get(client, background.URL+"/artifacts/session", t); resp.Header.Get("Set-Cookie") == "" {
+		t.Error("Expected the cookie of the client fetching the response")
+	}
+	if resp, _ := get(client, background.URL+"/artifacts/session", t); o.count("/artifacts/session") != 1 ||
+		resp.Header.Get("Set-Cookie") != "" {
+		t.Error("Expected the cached response without the cookie, got", resp.Header.Get("Set-Cookie"))
+	}
+
+	req, _ := http.NewRequest("PUT", background.URL+"/artifacts/a.tgz", strings.NewReader("new"))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	get(client, background.URL+"/artifacts/a.tgz", t)
+	if n := o.count("/artifacts/a.tgz"); n != 3 {
+		t.Error("Expected PUT to invalidate the cached response, origin got", n, "requests")
+	}
+}
+
+func TestMitmCaching(t *testing.T) {
+	o := newOrigin()
+	o.set("/fresh", 200, "fresh", "Cache-Control", "max-age=60")
+	background := httptest.NewTLSServer(o)
+	defer background.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Tr = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoRoundTrip(cache.New(cache.NewMemoryStore(1 << 20)))
+	client, proxyserver := oneShotProxy(proxy)
+	defer proxyserver.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, b := get(client, background.URL+"/fresh", t); b != "fresh" {
+			t.Error("Unexpected body", b)
+		}
+	}
+	if n := o.count("/fresh"); n != 1 {
+		t.Error("Expected man in the middle'd responses to be cached, origin got", n, "requests")
+	}
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := cache.NewDiskStore(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(key, body string) {
+		w, err := s.Put(key, &cache.Entry{StatusCode: 200, Header: http.Header{"Etag": {`"` + key + `"`}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, body)
+		if err := w.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(s cache.Store, key string) string {
+		e, body, err := s.Get(key)
+		if err != nil {
+			return err.Error()
+		}
+		defer body.Close()
+		b, _ := io.ReadAll(body)
+		return fmt.Sprint(e.Key, e.Header.Get("Etag"), e.Size, string(b))
+	}
+	put("a", "first")
+	put("a", "second")
+	if got := read(s, "a"); got != `a"a"6second` {
+		t.Error("Unexpected entry", got)
+	}
+	if err := s.Update("a", &cache.Entry{StatusCode: 200, Header: http.Header{"Etag": {`"b"`}}}); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := cache.NewDiskStore(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := read(reopened, "a"); got != `a"b"6second` {
+		t.Error("Expected the entry to be kept on disk, got", got)
+	}
+	put("big1", strings.Repeat("x", 400))
+	put("big2", strings.Repeat("x", 400))
+	if got := read(s, "a"); got != cache.ErrNotFound.Error() {
+		t.Error("Expected the least recently used entry to be evicted, got", got)
+	}
+	s.Delete("big1")
+	if got := read(s, "big1"); got != cache.ErrNotFound.Error() {
+		t.Error("Expected the entry to be deleted, got", got)
+	}
+}
@@ -0,0 +1,297 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DiskStore is a Store keeping the responses in a directory, evicting the least recently
+// used ones when they exceed its capacity. Each entry is a metadata file, named after the
+// hash of its key, pointing to a body file, so that the body of an entry being read is not
+// replaced under the reader.
+type DiskStore struct {
+	dir      string
+	capacity int64
+	mu       sync.Mutex
+	size     int64
+	// lru holds the *diskEntry, the most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type diskEntry struct {
+	name string
+	size int64
+}
+
+// diskMeta is the content of the metadata file of an entry
+type diskMeta struct {
+	Entry
+	Body string
+}
+
+// NewDiskStore returns the store of the responses in dir, holding up to capacity bytes, or
+// any amount if capacity is not positive. The entries already in dir are kept.
+func NewDiskStore(dir string, capacity int64) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &DiskStore{dir: dir, capacity: capacity, lru: list.New(), entries: map[string]*list.Element{}}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type found struct {
+		diskEntry
+		used int64
+	}
+	var entries []found
+	bodies := map[string]bool{}
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), ".meta")
+		if name == f.Name() {
+			continue
+		}
+		meta, err := s.readMeta(name)
+		info, ierr := f.Info()
+		if err != nil || ierr != nil {
+			os.Remove(s.path(f.Name()))
+			continue
+		}
+		bodies[meta.Body] = true
+		entries = append(entries, found{diskEntry{name, meta.Size + info.Size()}, info.ModTime().UnixNano()})
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".tmp") || (strings.HasSuffix(f.Name(), ".body") && !bodies[f.Name()]) {
+			// left over by an interrupted Put
+			os.Remove(s.path(f.Name()))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used > entries[j].used })
+	for _, e := range entries {
+		de := e.diskEntry
+		s.entries[e.name] = s.lru.PushBack(&de)
+		s.size += e.size
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict()
+	return s, nil
+}
+
+func (s *DiskStore) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+func fileName(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+func (s *DiskStore) readMeta(name string) (*diskMeta, error) {
+	b, err := os.ReadFile(s.path(name + ".meta"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	meta := &diskMeta{}
+	if err := json.Unmarshal(b, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// writeMeta atomically replaces the metadata file of name with meta, returning its size
+func (s *DiskStore) writeMeta(name string, meta *diskMeta) (int64, error) {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(s.dir, name+"-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(name+".meta"))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+	return int64(len(b)), nil
+}
+
+func (s *DiskStore) Get(key string) (*Entry, io.ReadCloser, error) {
+	name := fileName(key)
+	meta, err := s.readMeta(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta.Key != key {
+		return nil, nil, ErrNotFound
+	}
+	body, err := os.Open(s.path(meta.Body))
+	if errors.Is(err, os.ErrNotExist) {
+		// replaced or deleted since the metadata was read
+		return nil, nil, ErrNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	s.mu.Lock()
+	if el := s.entries[name]; el != nil {
+		s.lru.MoveToFront(el)
+	}
+	s.mu.Unlock()
+	return &meta.Entry, body, nil
+}
+
+func (s *DiskStore) Put(key string, e *Entry) (EntryWriter, error) {
+	name := fileName(key)
+	f, err := os.CreateTemp(s.dir, name+"-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	e = e.clone()
+	e.Key = key
+	return &diskWriter{s: s, name: name, e: e, f: f}, nil
+}
+
+func (s *DiskStore) Update(key string, e *Entry) error {
+	name := fileName(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	meta, err := s.readMeta(name)
+	if err != nil {
+		return err
+	}
+	if meta.Key != key {
+		return ErrNotFound
+	}
+	size := meta.Size
+	meta.Entry = *e.clone()
+	meta.Key, meta.Size = key, size
+	metaSize, err := s.writeMeta(name, meta)
+	if err != nil {
+		return err
+	}
+	s.track(name, size+metaSize)
+	return nil
+}
+
+func (s *DiskStore) Delete(key string) error {
+	name := fileName(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if meta, err := s.readMeta(name); err != nil || meta.Key != key {
+		return nil
+	}
+	if el := s.entries[name]; el != nil {
+		s.remove(el)
+	} else {
+		s.removeFiles(name)
+	}
+	return nil
+}
+
+// track records that the entry name of size was used, s being locked
+func (s *DiskStore) track(name string, size int64) {
+	if el := s.entries[name]; el != nil {
+		de := el.Value.(*diskEntry)
+		s.size += size - de.size
+		de.size = size
+		s.lru.MoveToFront(el)
+	} else {
+		s.entries[name] = s.lru.PushFront(&diskEntry{name, size})
+		s.size += size
+	}
+}
+
+func (s *DiskStore) removeFiles(name string) {
+	meta, err := s.readMeta(name)
+	os.Remove(s.path(name + ".meta"))
+	if err == nil {
+		os.Remove(s.path(meta.Body))
+	}
+}
+
+// remove removes the entry of el, s being locked
+func (s *DiskStore) remove(el *list.Element) {
+	de := s.lru.Remove(el).(*diskEntry)
+	delete(s.entries, de.name)
+	s.size -= de.size
+	s.removeFiles(de.name)
+}
+
+// evict removes the least recently used entries until s fits its capacity, s being locked
+func (s *DiskStore) evict() {
+	for s.capacity > 0 && s.size > s.capacity && s.lru.Len() > 0 {
+		s.remove(s.lru.Back())
+	}
+}
+
+type diskWriter struct {
+	s    *DiskStore
+	name string
+	e    *Entry
+	f    *os.File
+	size int64
+}
+
+func (w *diskWriter) Write(p []byte) (int, error) {
+	if w.s.capacity > 0 && w.size+int64(len(p)) > w.s.capacity {
+		return 0, errors.New("cache: body larger than the store")
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *diskWriter) Commit() error {
+	s := w.s
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	var suffix [8]byte
+	rand.Read(suffix[:])
+	body := w.name + "-" + hex.EncodeToString(suffix[:]) + ".body"
+	if err := os.Rename(w.f.Name(), s.path(body)); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, oldErr := s.readMeta(w.name)
+	w.e.Size = w.size
+	metaSize, err := s.writeMeta(w.name, &diskMeta{Entry: *w.e, Body: body})
+	if err != nil {
+		os.Remove(s.path(body))
+		return err
+	}
+	if oldErr == nil && old.Body != body {
+		os.Remove(s.path(old.Body))
+	}
+	s.track(w.name, w.size+metaSize)
+	s.evict()
+	return nil
+}
+
+func (w *diskWriter) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by the stores for the keys they have no entry for
+var ErrNotFound = errors.New("cache: entry not found")
+
+// Entry is a stored response, without its body
+type Entry struct {
+	Key        string
+	StatusCode int
+	Header     http.Header
+	// RequestTime and ResponseTime are when the request of the response was sent and when
+	// the response was received, to compute its age
+	RequestTime, ResponseTime time.Time
+	// Variants is set instead of a response on the entry of a URL whose responses vary, to
+	// the names of the request headers they vary by. The responses are stored under the
+	// keys of their variant, listed in VariantKeys so that they are removed with the URL.
+	Variants    []string `json:",omitempty"`
+	VariantKeys []string `json:",omitempty"`
+	// Size is the size of the body, set by the store
+	Size int64
+}
+
+func (e *Entry) clone() *Entry {
+	c := *e
+	c.Header = e.Header.Clone()
+	c.Variants = append([]string(nil), e.Variants...)
+	c.VariantKeys = append([]string(nil), e.VariantKeys...)
+	return &c
+}
+
+// A Store keeps the responses of a Cache. It must be safe for concurrent use.
+type Store interface {
+	// Get returns the entry stored under key and its body, which must be closed, or
+	// ErrNotFound
+	Get(key string) (*Entry, io.ReadCloser, error)
+	// Put returns the writer of the body of e, stored under key once the writer is
+	// committed, replacing the previous entry of key
+	Put(key string, e *Entry) (EntryWriter, error)
+	// Update replaces the entry stored under key, keeping its body
+	Update(key string, e *Entry) error
+	// Delete removes the entry stored under key, if any
+	Delete(key string) error
+}
+
+// EntryWriter writes the body of an entry to a Store. The entry is stored by Commit, or
+// discarded by Abort.
+type EntryWriter interface {
+	io.Writer
+	Commit() error
+	Abort()
+}
+
+// MemoryStore is a Store keeping the responses in memory, evicting the least recently used
+// ones when their bodies exceed its capacity
+type MemoryStore struct {
+	capacity int64
+	mu       sync.Mutex
+	size     int64
+	// lru holds the *memoryEntry, the most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type memoryEntry struct {
+	e    *Entry
+	body []byte
+}
+
+// NewMemoryStore returns an empty store holding up to capacity bytes of bodies, or any
+// amount if capacity is not positive
+func NewMemoryStore(capacity int64) *MemoryStore {
+	return &MemoryStore{capacity: capacity, lru: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (s *MemoryStore) Get(key string) (*Entry, io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el := s.entries[key]
+	if el == nil {
+		return nil, nil, ErrNotFound
+	}
+	s.lru.MoveToFront(el)
+	me := el.Value.(*memoryEntry)
+	return me.e.clone(), io.NopCloser(bytes.NewReader(me.body)), nil
+}
+
+func (s *MemoryStore) Put(key string, e *Entry) (EntryWriter, error) {
+	return &memoryWriter{s: s, key: key, e: e.clone()}, nil
+}
+
+func (s *MemoryStore) Update(key string, e *Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el := s.entries[key]
+	if el == nil {
+		return ErrNotFound
+	}
+	me := el.Value.(*memoryEntry)
+	size := me.e.Size
+	me.e = e.clone()
+	me.e.Size = size
+	return nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el := s.entries[key]; el != nil {
+		s.remove(el)
+	}
+	return nil
+}
+
+// remove removes the entry of el, s being locked
+func (s *MemoryStore) remove(el *list.Element) {
+	me := s.lru.Remove(el).(*memoryEntry)
+	delete(s.entries, me.e.Key)
+	s.size -= me.e.Size
+}
+
+type memoryWriter struct {
+	s   *MemoryStore
+	key string
+	e   *Entry
+	buf bytes.Buffer
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	if w.s.capacity > 0 && int64(w.buf.Len()+len(p)) > w.s.capacity {
+		return 0, errors.New("cache: body larger than the store")
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Commit() error {
+	s := w.s
+	w.e.Key, w.e.Size = w.key, int64(w.buf.Len())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el := s.entries[w.key]; el != nil {
+		s.remove(el)
+	}
+	s.entries[w.key] = s.lru.PushFront(&memoryEntry{e: w.e, body: w.buf.Bytes()})
+	s.size += w.e.Size
+	for s.capacity > 0 && s.size > s.capacity {
+		s.remove(s.lru.Back())
+	}
+	return nil
+}
+
+func (w *memoryWriter) Abort() {
+	w.buf = bytes.Buffer{}
+}
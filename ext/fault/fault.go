@@ -0,0 +1,206 @@
+// Package fault injects failures in the traffic going through the proxy, to test how clients
+// handle upstream failures. Faults are registered with the conditions they apply to, and
+// fire with a probability, each fault fired being logged in the session log.
+//	proxy.OnRequest(goproxy.ReqHostIs("api.example.com")).Do(fault.Status(503).WithProbability(0.1))
+//	proxy.OnResponse(goproxy.UrlHasPrefix("/downloads")).Do(fault.Reset(1024).WithProbability(0.05))
+//	proxy.OnRequest().HandleConnect(fault.FailConnect().WithProbability(0.01))
+package fault
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/marbemac/goproxy"
+)
+
+// ErrReset is the error the body of a response is cut with by Reset
+var ErrReset = errors.New("fault: connection reset")
+
+// fires reports whether a fault of probability p fires, logging it if it does
+func fires(p float64, name string, ctx *goproxy.ProxyCtx) bool {
+	if p < 1 && rand.Float64() >= p {
+		return false
+	}
+	ctx.Warnf("Injecting fault: %v", name)
+	return true
+}
+
+// sleep waits for d, or until the request is cancelled
+func sleep(d time.Duration, ctx *goproxy.ProxyCtx) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Context().Done():
+	}
+}
+
+// ReqFault is a fault injected in the requests, before they are sent upstream. It is a
+// ReqHandler.
+type ReqFault struct {
+	name        string
+	probability float64
+	f           func(req *http.Request, ctx *goproxy.ProxyCtx) *http.Response
+}
+
+// WithProbability makes the fault fire on a ratio p of the requests, instead of all of them
+func (f *ReqFault) WithProbability(p float64) *ReqFault {
+	f.probability = p
+	return f
+}
+
+func (f *ReqFault) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if !fires(f.probability, f.name, ctx) {
+		return req, nil
+	}
+	return req, f.f(req, ctx)
+}
+
+// Status answers the requests with a synthetic response of status code, instead of sending
+// them upstream
+func Status(code int) *ReqFault {
+	return &ReqFault{name: "status " + http.StatusText(code), probability: 1,
+		f: func(req *http.Request, ctx *goproxy.ProxyCtx) *http.Response {
+			return goproxy.NewResponse(req, goproxy.ContentTypeText, code, "injected fault\n")
+		}}
+}
+
+// Delay delays the requests by d before they are sent upstream
+func Delay(d time.Duration) *ReqFault {
+	return &ReqFault{name: "delay of " + d.String(), probability: 1,
+		f: func(req *http.Request, ctx *goproxy.ProxyCtx) *http.Response {
+			sleep(d, ctx)
+			return nil
+		}}
+}
+
+// RespFault is a fault injected in the responses, before they are sent to the client. It is
+// a RespHandler.
+type RespFault struct {
+	name        string
+	probability float64
+	f           func(resp *http.Response, ctx *goproxy.ProxyCtx)
+}
+
+// WithProbability makes the fault fire on a ratio p of the responses, instead of all of them
+func (f *RespFault) WithProbability(p float64) *RespFault {
+	f.probability = p
+	return f
+}
+
+func (f *RespFault) Handle(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || !fires(f.probability, f.name, ctx) {
+		return resp
+	}
+	f.f(resp, ctx)
+	return resp
+}
+
+// DelayResponse delays the responses by d, once they were received from upstream
+func DelayResponse(d time.Duration) *RespFault {
+	return &RespFault{name: "response delay of " + d.String(), probability: 1,
+		f: func(resp *http.Response, ctx *goproxy.ProxyCtx) {
+			sleep(d, ctx)
+		}}
+}
+
+// Reset cuts the connection to the client after n bytes of the response body were sent, so
+// that the client gets an incomplete response
+func Reset(n int64) *RespFault {
+	return &RespFault{name: "reset", probability: 1,
+		f: func(resp *http.Response, ctx *goproxy.ProxyCtx) {
+			resp.Body = &faultyBody{ReadCloser: resp.Body, remaining: n, err: ErrReset}
+		}}
+}
+
+// Truncate ends the response body after n bytes, the client being sent a complete response
+// with the truncated body
+func Truncate(n int64) *RespFault {
+	return &RespFault{name: "truncated body", probability: 1,
+		f: func(resp *http.Response, ctx *goproxy.ProxyCtx) {
+			resp.Body = &faultyBody{ReadCloser: resp.Body, remaining: n, err: io.EOF}
+			resp.ContentLength = -1
+			resp.Header.Del("Content-Length")
+		}}
+}
+
+// Corrupt replaces each byte of the response body with a random byte, with probability rate
+func Corrupt(rate float64) *RespFault {
+	return &RespFault{name: "corrupted body", probability: 1,
+		f: func(resp *http.Response, ctx *goproxy.ProxyCtx) {
+			resp.Body = &corruptBody{resp.Body, rate}
+		}}
+}
+
+// faultyBody fails with err once remaining bytes were read
+type faultyBody struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (b *faultyBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, b.err
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+type corruptBody struct {
+	io.ReadCloser
+	rate float64
+}
+
+func (b *corruptBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	for i := range p[:n] {
+		if rand.Float64() < b.rate {
+			p[i] = byte(rand.Intn(256))
+		}
+	}
+	return n, err
+}
+
+// ConnectFault is a fault injected in the CONNECT requests. It is an HttpsHandler, which must
+// run before the CONNECT handlers returning an action.
+type ConnectFault struct {
+	name        string
+	probability float64
+	f           func(host string, ctx *goproxy.ProxyCtx) *goproxy.ConnectAction
+}
+
+// WithProbability makes the fault fire on a ratio p of the CONNECT requests, instead of all
+// of them
+func (f *ConnectFault) WithProbability(p float64) *ConnectFault {
+	f.probability = p
+	return f
+}
+
+func (f *ConnectFault) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	if !fires(f.probability, f.name, ctx) {
+		return nil, host
+	}
+	return f.f(host, ctx), host
+}
+
+// FailConnect fails the CONNECT requests as if the destination could not be dialed, with a
+// 502 Bad Gateway response
+func FailConnect() *ConnectFault {
+	return &ConnectFault{name: "CONNECT dial failure", probability: 1,
+		f: func(host string, ctx *goproxy.ProxyCtx) *goproxy.ConnectAction {
+			resp := goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway,
+				"injected fault: cannot dial "+host+"\n")
+			resp.ProtoMajor, resp.ProtoMinor = 1, 1
+			resp.Close = true
+			ctx.Resp = resp
+			return goproxy.RejectConnect
+		}}
+}
@@ -0,0 +1,114 @@
+package fault_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marbemac/goproxy"
+	"github.com/marbemac/goproxy/ext/fault"
+)
+
+type ConstantHanlder string
+
+func (h ConstantHanlder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, string(h))
+}
+
+func oneShotProxy(proxy *goproxy.ProxyHttpServer) (client *http.Client, s *httptest.Server) {
+	s = httptest.NewServer(proxy)
+
+	proxyUrl, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyUrl)}
+	client = &http.Client{Transport: tr}
+	return
+}
+
+var body = strings.Repeat("0123456789", 1000)
+
+func get(client *http.Client, u string, t *testing.T) (*http.Response, string, error) {
+	resp, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return resp, string(b), err
+}
+
+func TestRequestFaults(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder(body))
+	defer background.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.UrlHasPrefix("/never")).Do(fault.Status(500).WithProbability(0))
+	proxy.OnRequest(goproxy.UrlHasPrefix("/status")).Do(fault.Status(503))
+	proxy.OnRequest(goproxy.UrlHasPrefix("/delay")).Do(fault.Delay(100 * time.Millisecond))
+	client, proxyserver := oneShotProxy(proxy)
+	defer proxyserver.Close()
+
+	if resp, b, _ := get(client, background.URL+"/never", t); resp.StatusCode != 200 || b != body {
+		t.Error("faults of probability 0 should not fire, got", resp.Status)
+	}
+	if resp, _, _ := get(client, background.URL+"/status", t); resp.StatusCode != 503 {
+		t.Error("Expected a synthetic 503, got", resp.Status)
+	}
+	start := time.Now()
+	if resp, b, _ := get(client, background.URL+"/delay", t); resp.StatusCode != 200 || b != body {
+		t.Error("delayed requests should be sent, got", resp.Status)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Error("Expected the request to be delayed, took", elapsed)
+	}
+}
+
+func TestResponseFaults(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder(body))
+	defer background.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnResponse(goproxy.UrlHasPrefix("/truncate")).Do(fault.Truncate(10))
+	proxy.OnResponse(goproxy.UrlHasPrefix("/reset")).Do(fault.Reset(10))
+	proxy.OnResponse(goproxy.UrlHasPrefix("/corrupt")).Do(fault.Corrupt(1))
+	client, proxyserver := oneShotProxy(proxy)
+	defer proxyserver.Close()
+
+	if _, b, err := get(client, background.URL+"/truncate", t); err != nil || b != body[:10] {
+		t.Error("Expected a complete truncated body, got", b, err)
+	}
+	if _, b, err := get(client, background.URL+"/reset", t); err == nil || len(b) > 10 {
+		t.Error("Expected the response to be cut, got", len(b), err)
+	}
+	if _, b, err := get(client, background.URL+"/corrupt", t); err != nil || len(b) != len(body) || b == body {
+		t.Error("Expected a corrupted body of the same length, got", len(b), err)
+	}
+}
+
+func TestFailConnect(t *testing.T) {
+	background := httptest.NewTLSServer(ConstantHanlder(body))
+	defer background.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(fault.FailConnect())
+	_, proxyserver := oneShotProxy(proxy)
+	defer proxyserver.Close()
+
+	c, err := net.Dial("tcp", proxyserver.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	host := background.Listener.Addr().String()
+	fmt.Fprintf(c, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", host, host)
+	resp, err := http.ReadResponse(bufio.NewReader(c), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Error("Expected the CONNECT to fail with 502, got", resp.Status)
+	}
+}
@@ -48,6 +48,8 @@ func HandleString(f func(s string, ctx *goproxy.ProxyCtx) string) goproxy.RespHa
 
 // Will recieve an input stream which would convert the response to utf-8
 // The given function must close the reader r, in order to close the response body.
+// Mark its Handle with ReadsBodies, for compressed bodies to be decoded first
+//	proxy.OnResponse(IsHtml).Do(goproxy_html.HandleString(f)).ReadsBodies()
 func HandleStringReader(f func(r io.Reader, ctx *goproxy.ProxyCtx) io.Reader) goproxy.RespHandler {
 	return goproxy.FuncRespHandler(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
 		if ctx.Error != nil {
@@ -102,3 +104,50 @@ func (rfcb *readFirstCloseBoth) Close() error {
 	}
 	return err2
 }
+
+// HandleRequestString will recieve a function that filters a string, and will convert the
+// request body to a utf8 string, according to the charset specified in the Content-Type
+// header of the request. The filtered string is converted back to the original charset.
+func HandleRequestString(f func(s string, ctx *goproxy.ProxyCtx) string) goproxy.ReqHandler {
+	return HandleRequestStringReader(func(r io.Reader, ctx *goproxy.ProxyCtx) io.Reader {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			ctx.Warnf("Cannot read string from req body: %v", err)
+			return r
+		}
+		return bytes.NewBufferString(f(string(b), ctx))
+	})
+}
+
+// Will recieve an input stream which would convert the request body to utf-8, like
+// HandleStringReader does for responses. The request is sent with chunked encoding.
+func HandleRequestStringReader(f func(r io.Reader, ctx *goproxy.ProxyCtx) io.Reader) goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if req.Body == nil || req.Body == http.NoBody {
+			return req, nil
+		}
+		charsetName := ctx.ReqCharset()
+		if charsetName == "" {
+			charsetName = "utf-8"
+		}
+
+		if strings.ToLower(charsetName) != "utf-8" {
+			r, err := charset.NewReader(charsetName, req.Body)
+			if err != nil {
+				ctx.Warnf("Cannot convert from %v to utf-8: %v", charsetName, err)
+				return req, nil
+			}
+			tr, err := charset.TranslatorTo(charsetName)
+			if err != nil {
+				ctx.Warnf("Can't translate to %v from utf-8: %v", charsetName, err)
+				return req, nil
+			}
+			newr := charset.NewTranslatingReader(f(r, ctx), tr)
+			goproxy.SetRequestBody(req, &readFirstCloseBoth{ioutil.NopCloser(newr), req.Body}, -1)
+		} else {
+			//no translation is needed, already at utf-8
+			goproxy.SetRequestBody(req, &readFirstCloseBoth{ioutil.NopCloser(f(req.Body, ctx)), req.Body}, -1)
+		}
+		return req, nil
+	})
+}
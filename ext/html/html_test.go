@@ -1,6 +1,7 @@
 package goproxy_html_test
 
 import (
+	"bytes"
 	"github.com/marbemac/goproxy"
 	"github.com/marbemac/goproxy/ext/html"
 	"io/ioutil"
@@ -58,3 +59,51 @@ func TestCharset(t *testing.T) {
 		t.Error("HandleString did not convert DALET & PEH SOFIT (דף) from ISO-8859-8 to utf-8, got", []byte(inHandleString))
 	}
 }
+
+type EchoServer int
+
+func (s EchoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	w.Write(b)
+}
+
+func TestRequestCharset(t *testing.T) {
+	s := httptest.NewServer(EchoServer(1))
+	defer s.Close()
+
+	ch := make(chan string, 2)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(goproxy_html.HandleRequestString(
+		func(s string, ctx *goproxy.ProxyCtx) string {
+			ch <- s
+			return s
+		}))
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	resp, err := client.Post(s.URL+"/echo", "text/plain; charset=iso-8859-8", bytes.NewReader([]byte{0xe3, 0xf3}))
+	if err != nil {
+		t.Fatal("POST:", err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("readAll:", err)
+	}
+	resp.Body.Close()
+
+	inHandleString := ""
+	select {
+	case inHandleString = <-ch:
+	default:
+	}
+
+	if len(b) != 2 || b[0] != 0xe3 || b[1] != 0xf3 {
+		t.Error("Did not translate request back to 0xe3,0xf3, instead", b)
+	}
+	if inHandleString != "דף" {
+		t.Error("HandleRequestString did not convert DALET & PEH SOFIT (דף) from ISO-8859-8 to utf-8, got", []byte(inHandleString))
+	}
+}
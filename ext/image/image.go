@@ -20,6 +20,8 @@ var RespIsImage = ContentTypeIs("image/gif",
 
 // "image/tiff" tiff support is in external package, and rarely used, so we omitted it
 
+// HandleImage calls f with the decoded images, replacing them with what it returns. Mark
+// its Handle with ReadsBodies, for compressed bodies to be decoded first.
 func HandleImage(f func(img image.Image, ctx *ProxyCtx) image.Image) RespHandler {
 	return FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
 		if !RespIsImage.HandleResp(resp, ctx) {
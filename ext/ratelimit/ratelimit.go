@@ -0,0 +1,190 @@
+// Package ratelimit limits the rate of the requests and CONNECT tunnels going through the
+// proxy, with token buckets keyed by client, user or destination.
+//	perClient := ratelimit.New(ratelimit.Limit{Rate: 10, Burst: 20}, ratelimit.ByClientIP)
+//	perClient.Register(proxy.OnRequest(goproxy.ReqHostIs("api.example.com")))
+package ratelimit
+
+import (
+	"encoding/base64"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marbemac/goproxy"
+)
+
+// Limit allows Rate requests per second on average, and bursts of up to Burst requests.
+// Rate must be positive, Burst is at least 1.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// PerMinute returns the Limit of n requests per minute, with bursts of up to burst requests
+func PerMinute(n float64, burst int) Limit {
+	return Limit{Rate: n / 60, Burst: burst}
+}
+
+// KeyFunc returns the key of the bucket req is counted in. Requests for which it returns ""
+// are not limited.
+type KeyFunc func(req *http.Request, ctx *goproxy.ProxyCtx) string
+
+// ByClientIP counts the requests of each client IP address
+var ByClientIP KeyFunc = func(req *http.Request, ctx *goproxy.ProxyCtx) string {
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return ip
+	}
+	return req.RemoteAddr
+}
+
+// ByDestination counts the requests to each destination host
+var ByDestination KeyFunc = func(req *http.Request, ctx *goproxy.ProxyCtx) string {
+	if req.URL.Host != "" {
+		return strings.ToLower(req.URL.Hostname())
+	}
+	return strings.ToLower(stripPort(req.Host))
+}
+
+// ByUser counts the requests of each user, as given by the basic Proxy-Authorization of the
+// requests, or of the CONNECT request of their man in the middle'd session. It is not
+// verified, so the limiter must be registered before the handlers authenticating the users
+// and removing Proxy-Authorization, such as those of ext/auth. Requests without a user are
+// not limited.
+var ByUser KeyFunc = func(req *http.Request, ctx *goproxy.ProxyCtx) string {
+	header := req.Header.Get("Proxy-Authorization")
+	if header == "" && ctx.ConnectReq != nil {
+		header = ctx.ConnectReq.Header.Get("Proxy-Authorization")
+	}
+	auth := strings.SplitN(header, " ", 2)
+	if len(auth) != 2 || !strings.EqualFold(auth[0], "Basic") {
+		return ""
+	}
+	userpass, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[1]))
+	if err != nil {
+		return ""
+	}
+	return strings.SplitN(string(userpass), ":", 2)[0]
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// sweepInterval is how often the buckets that filled up again are forgotten
+const sweepInterval = time.Minute
+
+// Limiter limits the rate of requests in a token bucket per key
+type Limiter struct {
+	limit     Limit
+	key       KeyFunc
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New returns a Limiter of the requests with the same key to limit
+func New(limit Limit, key KeyFunc) *Limiter {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &Limiter{limit: limit, key: key, buckets: make(map[string]*bucket)}
+}
+
+// Allow takes a token from the bucket of key. If it is empty, it returns false, and how long
+// until a token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) > sweepInterval {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+}
+
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	return math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+}
+
+// sweep forgets the full buckets, which are the same as new ones
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// TooManyRequests returns the 429 response to req, telling the client to retry after
+// retryAfter
+func TooManyRequests(req *http.Request, retryAfter time.Duration) *http.Response {
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusTooManyRequests, "429 Too Many Requests\n")
+	resp.ProtoMajor, resp.ProtoMinor = 1, 1
+	resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return resp
+}
+
+// allow counts req, and returns the response to send instead if it is over the limit
+func (l *Limiter) allow(req *http.Request, ctx *goproxy.ProxyCtx) *http.Response {
+	key := l.key(req, ctx)
+	if key == "" {
+		return nil
+	}
+	if ok, retryAfter := l.Allow(key); !ok {
+		ctx.Logf("Rate limit of %v exceeded, retry after %v", key, retryAfter)
+		return TooManyRequests(req, retryAfter)
+	}
+	return nil
+}
+
+// Handler returns a handler answering the requests over the limit with 429 Too Many Requests
+func (l *Limiter) Handler() goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, l.allow(req, ctx)
+	})
+}
+
+// ConnectHandler returns a handler rejecting the CONNECT requests over the limit, with a
+// 429 Too Many Requests response
+func (l *Limiter) ConnectHandler() goproxy.HttpsHandler {
+	return goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		if resp := l.allow(ctx.Req, ctx); resp != nil {
+			ctx.Resp = resp
+			return goproxy.RejectConnect, host
+		}
+		return nil, host
+	})
+}
+
+// Register limits both the requests and the CONNECT requests matching conds, such as
+// proxy.OnRequest(goproxy.ReqHostIs("api.example.com")). The requests of man in the
+// middle'd tunnels are counted as well, on top of their CONNECT request, which takes a
+// token of its own.
+func (l *Limiter) Register(conds *goproxy.ReqProxyConds) {
+	conds.Do(l.Handler())
+	conds.HandleConnect(l.ConnectHandler())
+}
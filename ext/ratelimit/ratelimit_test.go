@@ -0,0 +1,140 @@
+package ratelimit_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/marbemac/goproxy"
+	"github.com/marbemac/goproxy/ext/ratelimit"
+)
+
+type ConstantHanlder string
+
+func (h ConstantHanlder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, string(h))
+}
+
+func oneShotProxy(proxy *goproxy.ProxyHttpServer) (client *http.Client, s *httptest.Server) {
+	s = httptest.NewServer(proxy)
+
+	proxyUrl, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyUrl)}
+	client = &http.Client{Transport: tr}
+	return
+}
+
+func TestAllow(t *testing.T) {
+	l := ratelimit.New(ratelimit.Limit{Rate: 100, Burst: 2}, ratelimit.ByClientIP)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatal("requests within the burst should be allowed")
+		}
+	}
+	ok, retryAfter := l.Allow("a")
+	if ok || retryAfter <= 0 || retryAfter > 10*time.Millisecond {
+		t.Fatal("requests over the burst should wait for a token, got", ok, retryAfter)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Fatal("keys should have their own buckets")
+	}
+	time.Sleep(retryAfter)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("a token should be available after retryAfter")
+	}
+}
+
+func TestRateLimitedRequests(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("ok"))
+	defer background.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	ratelimit.New(ratelimit.PerMinute(1, 2), ratelimit.ByDestination).Register(proxy.OnRequest())
+	client, proxyserver := oneShotProxy(proxy)
+	defer proxyserver.Close()
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(background.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if i < 2 && resp.StatusCode != http.StatusOK {
+			t.Fatal("requests within the limit should be sent, got", resp.Status)
+		}
+		if i == 2 && (resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "60") {
+			t.Fatal("requests over the limit should get 429, got", resp.Status, resp.Header)
+		}
+	}
+}
+
+func TestRateLimitedConnect(t *testing.T) {
+	background := httptest.NewTLSServer(ConstantHanlder("ok"))
+	defer background.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	ratelimit.New(ratelimit.PerMinute(1, 1), ratelimit.ByUser).Register(proxy.OnRequest())
+	_, proxyserver := oneShotProxy(proxy)
+	defer proxyserver.Close()
+
+	connect := func(user string) *http.Response {
+		c, err := net.Dial("tcp", proxyserver.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		host := background.Listener.Addr().String()
+		fmt.Fprintf(c, "CONNECT %v HTTP/1.1\r\nHost: %v\r\nProxy-Authorization: Basic %v\r\n\r\n", host, host,
+			base64.StdEncoding.EncodeToString([]byte(user+":passwd")))
+		resp, err := http.ReadResponse(bufio.NewReader(c), &http.Request{Method: "CONNECT"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := connect("alice"); resp.StatusCode != http.StatusOK {
+		t.Fatal("tunnels within the limit should be connected, got", resp.Status)
+	}
+	if resp := connect("alice"); resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatal("tunnels over the limit should be rejected with 429, got", resp.Status)
+	}
+	if resp := connect("bob"); resp.StatusCode != http.StatusOK {
+		t.Fatal("users should have their own limits, got", resp.Status)
+	}
+}
+
+func TestRateLimitedMitmRequests(t *testing.T) {
+	background := httptest.NewTLSServer(ConstantHanlder("ok"))
+	defer background.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	// the CONNECT request takes a token, and its requests the others
+	ratelimit.New(ratelimit.PerMinute(1, 3), ratelimit.ByUser).Register(proxy.OnRequest())
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxyserver := httptest.NewServer(proxy)
+	defer proxyserver.Close()
+
+	// the client only authenticates the CONNECT request
+	proxyUrl, _ := url.Parse(proxyserver.URL)
+	proxyUrl.User = url.UserPassword("alice", "passwd")
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(background.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if i < 2 && resp.StatusCode != http.StatusOK {
+			t.Fatal("requests within the limit should be sent, got", resp.Status)
+		}
+		if i == 2 && resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatal("requests over the limit of the user of the tunnel should get 429, got", resp.Status)
+		}
+	}
+}
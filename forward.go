@@ -0,0 +1,189 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// hopHeaders apply to a single connection, and must not be forwarded, see RFC 7230
+// section 6.1. Proxy-Authorization is meant for the proxy.
+var hopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Upgrade"}
+
+// removeHopHeaders removes the hop-by-hop headers from h, including the ones listed in
+// its Connection header. TE is kept if it asks for trailers, which are forwarded. If
+// keepUpgrade, the upgrade is tunneled to the next hop, so Upgrade is kept and the
+// Connection header is set to Upgrade.
+func removeHopHeaders(h http.Header, keepUpgrade bool) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" && !(keepUpgrade && strings.EqualFold(name, "Upgrade")) {
+				h.Del(name)
+			}
+		}
+	}
+	trailers := headerHasToken(h, "Te", "trailers")
+	for _, name := range hopHeaders {
+		if !(keepUpgrade && name == "Upgrade") {
+			h.Del(name)
+		}
+	}
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+	if keepUpgrade {
+		h.Set("Connection", "Upgrade")
+	}
+}
+
+// via returns the Via entry of the proxy, commented with its token to detect loops
+func (proxy *ProxyHttpServer) via(proto string, major, minor int) string {
+	name := proxy.ViaName
+	if name == "" {
+		name = "goproxy"
+	}
+	name += " (" + proxy.viaToken() + ")"
+	if strings.HasPrefix(proto, "HTTP/") {
+		return fmt.Sprintf("%d.%d %s", major, minor, name)
+	}
+	return fmt.Sprintf("%s/%d.%d %s", strings.SplitN(proto, "/", 2)[0], major, minor, name)
+}
+
+// addForwarded adds the Via, Forwarded and X-Forwarded-* headers to req, received from a
+// client over scheme, if AddVia and AddForwarded are set. It tells ctx whether req already
+// went through the proxy beforehand.
+func (proxy *ProxyHttpServer) addForwarded(req *http.Request, ctx *ProxyCtx, scheme string) {
+	ctx.looped = proxy.loopsBack(req)
+	if proxy.AddVia {
+		req.Header.Add("Via", proxy.via(req.Proto, req.ProtoMajor, req.ProtoMinor))
+	}
+	if !proxy.AddForwarded {
+		return
+	}
+	forwarded := fmt.Sprintf("host=%q;proto=%s", req.Host, scheme)
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if strings.Contains(ip, ":") {
+			forwarded = fmt.Sprintf(`for="[%s]";%s`, ip, forwarded)
+		} else {
+			forwarded = "for=" + ip + ";" + forwarded
+		}
+		if prior := req.Header["X-Forwarded-For"]; len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	req.Header.Add("Forwarded", forwarded)
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", scheme)
+	}
+}
+
+// maxForwardsResponse applies the Max-Forwards header of TRACE and OPTIONS requests, see
+// RFC 7231 section 5.1.2. It returns the response of the proxy if it is the last hop req
+// may be forwarded to, nil if req is to be forwarded.
+func maxForwardsResponse(req *http.Request) *http.Response {
+	if req.Method != "TRACE" && req.Method != "OPTIONS" {
+		return nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(req.Header.Get("Max-Forwards")))
+	if err != nil {
+		return nil
+	}
+	if n > 0 {
+		req.Header.Set("Max-Forwards", strconv.Itoa(n-1))
+		return nil
+	}
+	if req.Method == "OPTIONS" {
+		return NewResponse(req, ContentTypeText, http.StatusOK, "")
+	}
+	// the proxy does not keep the request as received, the hop-by-hop headers, such as
+	// Proxy-Authorization, are already removed
+	dump, err := httputil.DumpRequest(req, false)
+	if err != nil {
+		return nil
+	}
+	return NewResponse(req, "message/http", http.StatusOK, string(dump))
+}
+
+// forwardResponse removes the hop-by-hop headers of resp, received from the destination
+// server, and adds Via if AddVia is set
+func (proxy *ProxyHttpServer) forwardResponse(resp *http.Response) {
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		removeHopHeaders(resp.Header, false)
+	}
+	if proxy.AddVia {
+		resp.Header.Add("Via", proxy.via(resp.Proto, resp.ProtoMajor, resp.ProtoMinor))
+	}
+}
+
+// continueReader is the body of a request from a man in the middle'd client expecting
+// 100 Continue before sending the body. 100 Continue is sent when the body is first read.
+type continueReader struct {
+	io.ReadCloser
+	w          io.Writer
+	mu         sync.Mutex
+	sent, done bool
+}
+
+var errBodyNotExpected = errors.New("request body read after the response")
+
+// expectContinue makes req, read from a client through w, send 100 Continue to the client
+// if it expects it. It returns nil if it does not.
+func expectContinue(req *http.Request, w io.Writer) *continueReader {
+	if !req.ProtoAtLeast(1, 1) || req.Body == nil || req.Body == http.NoBody ||
+		!headerHasToken(req.Header, "Expect", "100-continue") {
+		return nil
+	}
+	r := &continueReader{ReadCloser: req.Body, w: w}
+	req.Body = r
+	return r
+}
+
+func (r *continueReader) Read(b []byte) (int, error) {
+	r.mu.Lock()
+	if r.done && !r.sent {
+		r.mu.Unlock()
+		return 0, errBodyNotExpected
+	}
+	if !r.sent {
+		r.sent = true
+		if _, err := io.WriteString(r.w, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			r.mu.Unlock()
+			return 0, err
+		}
+	}
+	r.mu.Unlock()
+	return r.ReadCloser.Read(b)
+}
+
+// Close closes the body. If 100 Continue was not sent, the client did not send the body, so
+// it is not read, and 100 Continue won't be sent anymore.
+func (r *continueReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.sent {
+		r.done = true
+		return nil
+	}
+	return r.ReadCloser.Close()
+}
+
+// finish is called before the response is written to the client, after which 100 Continue
+// can't be sent. It reports whether it was, if not the client may or may not send the body,
+// so the connection must be closed after the response.
+func (r *continueReader) finish() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done = true
+	return r.sent
+}
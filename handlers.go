@@ -0,0 +1,280 @@
+package goproxy
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// HandlerKind tells in which chain a handler is registered
+type HandlerKind int
+
+const (
+	RequestHandlers HandlerKind = iota
+	ResponseHandlers
+	ConnectHandlers
+	WebSocketHandlers
+	RoundTripHandlers
+)
+
+func (k HandlerKind) String() string {
+	switch k {
+	case RequestHandlers:
+		return "request"
+	case ResponseHandlers:
+		return "response"
+	case ConnectHandlers:
+		return "connect"
+	case WebSocketHandlers:
+		return "websocket"
+	case RoundTripHandlers:
+		return "round trip"
+	}
+	return "unknown"
+}
+
+// Handle is returned when registering a handler. It can be used to name, prioritize,
+// disable or remove the handler while the proxy is serving. Handlers with a higher priority
+// run first, handlers with the same priority run in registration order. The default
+// priority is 0.
+//	h := proxy.OnRequest(goproxy.ReqHostIs("ads.example.com:80")).DoFunc(block).
+//		Named("block-ads").WithPriority(10)
+//	...
+//	h.Disable()
+type Handle struct {
+	reg  *handlerRegistry
+	kind HandlerKind
+	// handler is a ReqHandler, RespHandler, HttpsHandler, WebSocketHandler or RoundTripHandler,
+	// depending on kind
+	handler interface{}
+	seq     int64
+
+	// guarded by reg.mu
+	name        string
+	priority    int
+	disabled    bool
+	removed     bool
+	readsBodies bool
+}
+
+// Kind returns the chain the handler is registered in
+func (h *Handle) Kind() HandlerKind {
+	return h.kind
+}
+
+// Name returns the name of the handler, empty if it was not named
+func (h *Handle) Name() string {
+	h.reg.mu.Lock()
+	defer h.reg.mu.Unlock()
+	return h.name
+}
+
+// Named sets the name of the handler, and returns h
+func (h *Handle) Named(name string) *Handle {
+	h.reg.mu.Lock()
+	defer h.reg.mu.Unlock()
+	h.name = name
+	return h
+}
+
+// ReadsBodies marks the response or round trip handler as reading the bodies of the
+// responses, which the proxy then asks to be encoded as it can decode them, so that the
+// handler sees them decoded, see RegisterContentEncoding. The handlers of HandleBytes and
+// HandleStream are marked already. It returns h.
+func (h *Handle) ReadsBodies() *Handle {
+	h.reg.mu.Lock()
+	defer h.reg.mu.Unlock()
+	h.readsBodies = true
+	h.reg.publishLocked()
+	return h
+}
+
+// Priority returns the priority of the handler
+func (h *Handle) Priority() int {
+	h.reg.mu.Lock()
+	defer h.reg.mu.Unlock()
+	return h.priority
+}
+
+// WithPriority sets the priority of the handler, reordering its chain, and returns h
+func (h *Handle) WithPriority(priority int) *Handle {
+	h.reg.mu.Lock()
+	defer h.reg.mu.Unlock()
+	h.priority = priority
+	h.reg.publishLocked()
+	return h
+}
+
+// Enabled reports whether the handler is registered and not disabled
+func (h *Handle) Enabled() bool {
+	h.reg.mu.Lock()
+	defer h.reg.mu.Unlock()
+	return !h.disabled && !h.removed
+}
+
+// Enable makes a disabled handler run again
+func (h *Handle) Enable() {
+	h.setDisabled(false)
+}
+
+// Disable stops the handler from running, until Enable is called
+func (h *Handle) Disable() {
+	h.setDisabled(true)
+}
+
+func (h *Handle) setDisabled(disabled bool) {
+	h.reg.mu.Lock()
+	defer h.reg.mu.Unlock()
+	h.disabled = disabled
+	h.reg.publishLocked()
+}
+
+// Remove unregisters the handler. It returns false if the handler was already removed.
+func (h *Handle) Remove() bool {
+	h.reg.mu.Lock()
+	defer h.reg.mu.Unlock()
+	if h.removed {
+		return false
+	}
+	h.removed = true
+	for i, other := range h.reg.all {
+		if other == h {
+			h.reg.all = append(h.reg.all[:i:i], h.reg.all[i+1:]...)
+			break
+		}
+	}
+	h.reg.publishLocked()
+	return true
+}
+
+// activeHandlers are the enabled handlers of each chain, in the order they run.
+// It is never modified once published, so it can be used without locking.
+type activeHandlers struct {
+	req   []ReqHandler
+	resp  []RespHandler
+	https []HttpsHandler
+	ws    []WebSocketHandler
+	// roundTrip is the chain of RoundTripHandlers around sending a request
+	roundTrip RoundTripper
+	// readsBodies is whether there are handlers marked as reading the response bodies, which
+	// the proxy then asks to be encoded as it can decode them, see negotiateEncoding
+	readsBodies bool
+}
+
+var noHandlers = &activeHandlers{roundTrip: sendRequest}
+
+// handlerRegistry holds the handlers of a proxy. Changes are published as a new
+// activeHandlers, so that requests being served see the handlers either before or
+// after a change, never in between.
+type handlerRegistry struct {
+	mu     sync.Mutex
+	all    []*Handle
+	seq    int64
+	batch  int
+	active atomic.Pointer[activeHandlers]
+}
+
+func (r *handlerRegistry) load() *activeHandlers {
+	if a := r.active.Load(); a != nil {
+		return a
+	}
+	return noHandlers
+}
+
+func (r *handlerRegistry) add(kind HandlerKind, handler interface{}) *Handle {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	h := &Handle{reg: r, kind: kind, handler: handler, seq: r.seq}
+	r.all = append(r.all, h)
+	r.publishLocked()
+	return h
+}
+
+// sortedLocked returns the handlers in the order they run
+func (r *handlerRegistry) sortedLocked() []*Handle {
+	sorted := append([]*Handle(nil), r.all...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].priority > sorted[j].priority
+	})
+	return sorted
+}
+
+func (r *handlerRegistry) publishLocked() {
+	if r.batch > 0 {
+		return
+	}
+	a := &activeHandlers{}
+	var roundTrips []RoundTripHandler
+	for _, h := range r.sortedLocked() {
+		if h.disabled {
+			continue
+		}
+		switch h.kind {
+		case RequestHandlers:
+			a.req = append(a.req, h.handler.(ReqHandler))
+		case ResponseHandlers:
+			a.resp = append(a.resp, h.handler.(RespHandler))
+			a.readsBodies = a.readsBodies || h.readsBodies
+		case ConnectHandlers:
+			a.https = append(a.https, h.handler.(HttpsHandler))
+		case WebSocketHandlers:
+			a.ws = append(a.ws, h.handler.(WebSocketHandler))
+		case RoundTripHandlers:
+			roundTrips = append(roundTrips, h.handler.(RoundTripHandler))
+			a.readsBodies = a.readsBodies || h.readsBodies
+		}
+	}
+	a.roundTrip = chainRoundTrip(roundTrips, sendRequest)
+	r.active.Store(a)
+}
+
+// Handlers returns the handlers registered in the chain kind, including disabled ones,
+// in the order they run.
+func (proxy *ProxyHttpServer) Handlers(kind HandlerKind) []*Handle {
+	r := &proxy.handlers
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var handles []*Handle
+	for _, h := range r.sortedLocked() {
+		if h.kind == kind {
+			handles = append(handles, h)
+		}
+	}
+	return handles
+}
+
+// UpdateHandlers calls f, and makes the changes f made to the handlers visible at once:
+// a request being served sees either none or all of them. For example, to replace a
+// handler with another
+//	proxy.UpdateHandlers(func() {
+//		old.Remove()
+//		proxy.OnRequest().Do(replacement).Named(old.Name())
+//	})
+func (proxy *ProxyHttpServer) UpdateHandlers(f func()) {
+	r := &proxy.handlers
+	r.mu.Lock()
+	r.batch++
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.batch--
+		r.publishLocked()
+		r.mu.Unlock()
+	}()
+	f()
+}
+
+// chainRoundTrip returns a RoundTripper calling each of handlers around the next one, and
+// the last one around last
+func chainRoundTrip(handlers []RoundTripHandler, last RoundTripper) RoundTripper {
+	next := last
+	for i := len(handlers) - 1; i >= 0; i-- {
+		h, inner := handlers[i], next
+		next = RoundTripperFunc(func(req *http.Request, ctx *ProxyCtx) (*http.Response, error) {
+			return h.HandleRoundTrip(req, ctx, inner)
+		})
+	}
+	return next
+}
@@ -116,6 +116,12 @@ func (p *proxyHelper) PostflightCorsSupport(resp *http.Response, ctx *goproxy.Pr
 
 func (p *proxyHelper) SetupResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
 	data := p.requestData[ctx.Session]
+	if data != nil {
+		// Keep the tries of the request, retried ones included
+		for _, a := range ctx.Attempts {
+			data.AddAttempt(&request.BaseAttempt{Error: a.Error, Duration: a.Duration, Response: a.Response, Endpoint: a.Endpoint})
+		}
+	}
 	if resp == nil || data == nil || data.Skip {
 		return resp
 	}
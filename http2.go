@@ -0,0 +1,81 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// serveMitmHTTP2 serves an HTTP/2 connection with a man in the middle'd client, whose
+// TLS handshake is done. Streams are concurrent, so each is handled as a separate request
+// with its own ProxyCtx, inheriting the RoundTripper, UserData, Timeouts and Upstream of the
+// CONNECT ctx. The contexts of the streams are children of the context of the CONNECT ctx.
+// serveMitmHTTP2 returns when the connection is closed. On proxy shutdown, the client is
+// sent a GOAWAY frame, and the connection is closed once its streams are done.
+func (proxy *ProxyHttpServer) serveMitmHTTP2(conn *tls.Conn, client *trackedConn, host string, ctx *ProxyCtx) {
+	l := &oneConnListener{conn: conn, closed: make(chan bool)}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			streamCtx := &ProxyCtx{Req: req, Session: atomic.AddInt64(&proxy.sess, 1), proxy: proxy,
+				ConnectReq: ctx.Req, RoundTripper: ctx.RoundTripper, UserData: ctx.UserData,
+				context: req.Context(), Timeouts: ctx.Timeouts, Retry: ctx.Retry,
+				Upstream: ctx.Upstream, Network: ctx.Network, shaped: ctx.shaped}
+			req.URL.Scheme = "https"
+			req.URL.Host = host
+			proxy.addForwarded(req, streamCtx, "https")
+			proxy.handleHttp(w, req, streamCtx)
+		}),
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				l.close()
+			}
+		},
+		ErrorLog: proxy.Logger,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx.Context()
+		},
+	}
+	if !client.idleUntil(func() { srv.Shutdown(context.Background()) }) {
+		return
+	}
+	srv.Serve(l)
+}
+
+// oneConnListener is a net.Listener accepting a single connection. Once it was accepted,
+// Accept blocks until the connection is closed, so that http.Server.Serve returns only
+// when done serving it.
+type oneConnListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan bool
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if c := l.conn; c != nil {
+		l.conn = nil
+		return c, nil
+	}
+	<-l.closed
+	return nil, io.EOF
+}
+
+func (l *oneConnListener) close() {
+	l.once.Do(func() { close(l.closed) })
+}
+
+func (l *oneConnListener) Close() error {
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return dummyAddr("mitm")
+}
+
+type dummyAddr string
+
+func (a dummyAddr) Network() string { return string(a) }
+func (a dummyAddr) String() string  { return string(a) }
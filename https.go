@@ -2,17 +2,20 @@ package goproxy
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
-	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type ConnectActionLiteral int
@@ -33,9 +36,12 @@ var (
 )
 
 type ConnectAction struct {
-	Action    ConnectActionLiteral
+	Action ConnectActionLiteral
+	// Hijack takes over the client connection. Shutdown waits until the connection is closed.
 	Hijack    func(req *http.Request, client net.Conn, ctx *ProxyCtx)
 	TLSConfig func(host string, ctx *ProxyCtx) (*tls.Config, error)
+	// Timeouts, if not nil, overrides the timeouts of the proxy for the CONNECT session
+	Timeouts *Timeouts
 }
 
 func stripPort(s string) string {
@@ -48,9 +54,14 @@ func stripPort(s string) string {
 
 func (proxy *ProxyHttpServer) dial(network, addr string) (c net.Conn, err error) {
 	if proxy.Tr.Dial != nil {
-		return proxy.Tr.Dial(network, addr)
+		c, err = proxy.Tr.Dial(network, addr)
+	} else {
+		c, err = net.Dial(network, addr)
 	}
-	return net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return proxy.checkDialed(c)
 }
 
 func (proxy *ProxyHttpServer) connectDial(network, addr string) (c net.Conn, err error) {
@@ -61,111 +72,141 @@ func (proxy *ProxyHttpServer) connectDial(network, addr string) (c net.Conn, err
 }
 
 func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request) {
-	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), proxy: proxy}
+	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), proxy: proxy, Timeouts: proxy.Timeouts,
+		Retry: proxy.Retry}
 
 	hij, ok := w.(http.Hijacker)
 	if !ok {
-		panic("httpserver does not support hijacking")
+		proxy.respondError(w, r, ctx, ErrorProxy, errors.New("httpserver does not support hijacking"))
+		return
 	}
 
-	proxyClient, _, e := hij.Hijack()
+	conn, _, e := hij.Hijack()
 	if e != nil {
-		panic("Cannot hijack connection " + e.Error())
+		proxy.respondError(w, r, ctx, ErrorProxy, errors.New("Cannot hijack connection "+e.Error()))
+		return
 	}
-
-	ctx.Logf("Running %d CONNECT handlers", len(proxy.httpsHandlers))
-	todo, host := OkConnect, r.URL.Host
-	for i, h := range proxy.httpsHandlers {
-		newtodo, newhost := h.HandleConnect(host, ctx)
-
-		// If found a result, break the loop immediately
-		if newtodo != nil {
-			todo, host = newtodo, newhost
-			ctx.Logf("on %dth handler: %v %s", i, todo, host)
-			break
+	// the request context is cancelled once we return, while the session may go on
+	proxyClient, ok := proxy.sessions.track(context.WithoutCancel(r.Context()), conn)
+	if !ok {
+		io.WriteString(conn, "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\n\r\n")
+		conn.Close()
+		return
+	}
+	ctx.context = proxyClient.ctx
+	// net/http recovers the panics of its handlers, but it knows nothing about the hijacked
+	// connection, which must be closed
+	defer func() {
+		if v := recover(); v != nil {
+			proxy.recovered(ctx, v)
+			proxyClient.Close()
 		}
+	}()
+
+	todo, host, ok := proxy.filterConnect(r.URL.Host, ctx)
+	if !ok {
+		proxy.httpError(proxyClient, ctx, ErrorHandlerPanic, ctx.Error)
+		return
+	}
+	if todo.Timeouts != nil {
+		ctx.Timeouts = *todo.Timeouts
 	}
+	connectDial := proxy.connectDial
+	if p := ctx.Network; p != nil && todo.Action != ConnectReject {
+		ctx.Logf("Shaping the traffic of %v", r.RemoteAddr)
+		leg := p.leg()
+		proxyClient.wrap(func(c net.Conn) net.Conn { return shapeConn(c, leg, false) })
+		connectDial = shapeDial(connectDial, leg)
+		ctx.shaped = true
+	}
+	session := mitmSession{connect: r, client: proxyClient, timeouts: ctx.Timeouts, retry: ctx.Retry,
+		upstream: ctx.Upstream}
 	switch todo.Action {
 	case ConnectAccept:
 		if !hasPort.MatchString(host) {
 			host += ":80"
 		}
-		targetSiteCon, err := proxy.connectDial("tcp", host)
+		targetSiteCon, err := dialTimeout(connectDial, "tcp", host, ctx.Timeouts.Dial)
 		if err != nil {
-			httpError(proxyClient, ctx, err)
+			proxy.httpError(proxyClient, ctx, ErrorDial, err)
 			return
 		}
 		ctx.Logf("Accepting CONNECT to %s", host)
 		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
-		go copyAndClose(ctx, targetSiteCon, proxyClient)
-		go copyAndClose(ctx, proxyClient, targetSiteCon)
+		conns, _ := idleTimeout(ctx, ctx.Timeouts.IdleTunnel, targetSiteCon, proxyClient)
+		proxy.goFunc(ctx, func() { copyAndClose(ctx, conns[0], conns[1]) })
+		proxy.goFunc(ctx, func() { copyAndClose(ctx, conns[1], conns[0]) })
 	case ConnectHijack:
 		ctx.Logf("Hijacking CONNECT to %s", host)
 		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 		todo.Hijack(r, proxyClient, ctx)
 	case ConnectHTTPMitm:
-		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
-		ctx.Logf("Assuming CONNECT is plain HTTP tunneling, mitm proxying it")
-		targetSiteCon, err := proxy.connectDial("tcp", host)
+		targetSiteCon, err := dialTimeout(connectDial, "tcp", host, ctx.Timeouts.Dial)
 		if err != nil {
 			ctx.Warnf("Error dialing to %s: %s", host, err.Error())
+			proxy.httpError(proxyClient, ctx, ErrorDial, err)
 			return
 		}
-		for {
-			client := bufio.NewReader(proxyClient)
-			remote := bufio.NewReader(targetSiteCon)
-			req, err := http.ReadRequest(client)
+		// the requests to the destination of the CONNECT are sent over the dialed connection
+		ctx.tunnel = newConnTransport(r.Host, host, targetSiteCon, connectDial, ctx.Timeouts.Dial)
+		defer ctx.tunnel.Close()
+		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		ctx.Logf("Assuming CONNECT is plain HTTP tunneling, mitm proxying it")
+		defer proxyClient.Close()
+		s := &session
+		s.conn, s.r, s.scheme = proxyClient, bufio.NewReader(proxyClient), "http"
+		for proxyClient.idle() && !nextIsEof(s.r, s.eof) {
+			proxyClient.active()
+			req, err := http.ReadRequest(s.r)
 			if err != nil && err != io.EOF {
 				ctx.Warnf("cannot read request of MITM HTTP client: %+#v", err)
 			}
 			if err != nil {
 				return
 			}
-			req, resp := proxy.filterRequest(req, ctx)
-			if resp == nil {
-				if err := req.Write(targetSiteCon); err != nil {
-					httpError(proxyClient, ctx, err)
-					return
-				}
-				resp, err = http.ReadResponse(remote, req)
-				if err != nil {
-					httpError(proxyClient, ctx, err)
-					return
-				}
-			}
-			resp = proxy.filterResponse(resp, ctx)
-			if err := resp.Write(proxyClient); err != nil {
-				httpError(proxyClient, ctx, err)
+			if !proxy.serveMitmRequest(s, req, ctx) {
 				return
 			}
 		}
 	case ConnectMitm:
-		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 		ctx.Logf("Assuming CONNECT is TLS, mitm proxying it")
 		// this goes in a separate goroutine, so that the net/http server won't think we're
 		// still handling the request even after hijacking the connection. Those HTTP CONNECT
 		// request can take forever, and the server will be stuck when "closed".
-		// TODO: Allow Server.Close() mechanism to shut down this connection as nicely as possible
+		// Use proxy.Shutdown to shut down this connection nicely.
 		tlsConfig := defaultTLSConfig
 		if todo.TLSConfig != nil {
 			var err error
 			tlsConfig, err = todo.TLSConfig(host, ctx)
 			if err != nil {
-				httpError(proxyClient, ctx, err)
+				proxy.httpError(proxyClient, ctx, ErrorProxy, err)
 				return
 			}
 		}
-		go func() {
+		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		if proxy.MitmHTTP2 {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+		proxy.goFunc(ctx, func() {
 			//TODO: cache connections to the remote website
 			rawClientTls := tls.Server(proxyClient, tlsConfig)
-			if err := rawClientTls.Handshake(); err != nil {
+			defer rawClientTls.Close()
+			if err := tlsHandshake(proxyClient.ctx, rawClientTls, ctx.Timeouts.TLSHandshake); err != nil {
+				ctx.Error = err
 				ctx.Warnf("Cannot handshake client %v %v", r.Host, err)
 				return
 			}
-			defer rawClientTls.Close()
-			clientTlsReader := bufio.NewReader(rawClientTls)
-			for !isEof(clientTlsReader) {
-				req, err := http.ReadRequest(clientTlsReader)
+			if rawClientTls.ConnectionState().NegotiatedProtocol == "h2" {
+				ctx.Logf("Serving HTTP/2 to mitm'd client %v", r.Host)
+				proxy.serveMitmHTTP2(rawClientTls, proxyClient, r.Host, ctx)
+				return
+			}
+			s := &session
+			s.conn, s.r, s.scheme = rawClientTls, bufio.NewReader(rawClientTls), "https"
+			for proxyClient.idle() && !nextIsEof(s.r, s.eof) {
+				proxyClient.active()
+				req, err := http.ReadRequest(s.r)
 				if err != nil && err != io.EOF {
 					return
 				}
@@ -174,60 +215,12 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 					return
 				}
 				ctx.Logf("req %v", r.Host)
-				req.URL, err = url.Parse("https://" + r.Host + req.URL.String())
-				req, resp := proxy.filterRequest(req, ctx)
-				if resp == nil {
-					if err != nil {
-						ctx.Warnf("Illegal URL %s", "https://"+r.Host+req.URL.Path)
-						return
-					}
-					removeProxyHeaders(ctx, req)
-					resp, err = ctx.RoundTrip(req)
-					if err != nil {
-						ctx.Warnf("Cannot read TLS response from mitm'd server %v", err)
-						return
-					}
-					ctx.Logf("resp %v", resp.Status)
-				}
-				resp = proxy.filterResponse(resp, ctx)
-				text := resp.Status
-				statusCode := strconv.Itoa(resp.StatusCode) + " "
-				if strings.HasPrefix(text, statusCode) {
-					text = text[len(statusCode):]
-				}
-				// always use 1.1 to support chunked encoding
-				if _, err := io.WriteString(rawClientTls, "HTTP/1.1"+" "+statusCode+text+"\r\n"); err != nil {
-					ctx.Warnf("Cannot write TLS response HTTP status from mitm'd client: %v", err)
-					return
-				}
-				// Since we don't know the length of resp, return chunked encoded response
-				// TODO: use a more reasonable scheme
-				resp.Header.Del("Content-Length")
-				resp.Header.Set("Transfer-Encoding", "chunked")
-				if err := resp.Header.Write(rawClientTls); err != nil {
-					ctx.Warnf("Cannot write TLS response header from mitm'd client: %v", err)
-					return
-				}
-				if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
-					ctx.Warnf("Cannot write TLS response header end from mitm'd client: %v", err)
-					return
-				}
-				chunked := newChunkedWriter(rawClientTls)
-				if _, err := io.Copy(chunked, resp.Body); err != nil {
-					ctx.Warnf("Cannot write TLS response body from mitm'd client: %v", err)
-					return
-				}
-				if err := chunked.Close(); err != nil {
-					ctx.Warnf("Cannot write TLS chunked EOF from mitm'd client: %v", err)
-					return
-				}
-				if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
-					ctx.Warnf("Cannot write TLS response chunked trailer from mitm'd client: %v", err)
+				if !proxy.serveMitmRequest(s, req, ctx) {
 					return
 				}
 			}
 			ctx.Logf("Exiting on EOF")
-		}()
+		})
 	case ConnectReject:
 		if ctx.Resp != nil {
 			if err := ctx.Resp.Write(proxyClient); err != nil {
@@ -238,8 +231,357 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 	}
 }
 
-func httpError(w io.WriteCloser, ctx *ProxyCtx, err error) {
-	if _, err := io.WriteString(w, "HTTP/1.1 502 Bad Gateway\r\n\r\n"); err != nil {
+// mitmSession is a man in the middle'd CONNECT session, whose client sends requests to the
+// destination of the CONNECT request
+type mitmSession struct {
+	connect *http.Request
+	// client is the tracked connection of the client, and conn the connection the requests
+	// are read from, through r, and the responses written to
+	client *trackedConn
+	conn   net.Conn
+	r      *bufio.Reader
+	scheme string
+	// the settings of the CONNECT ctx, which each request starts from
+	timeouts Timeouts
+	retry    *RetryPolicy
+	upstream string
+	// eof is the result of watchClient for the last request
+	eof <-chan bool
+}
+
+// serveMitmRequest serves req, read from the client of s, as handleHttp does for the
+// requests sent to the proxy. It reports whether the client connection can be read from
+// again.
+func (proxy *ProxyHttpServer) serveMitmRequest(s *mitmSession, req *http.Request, ctx *ProxyCtx) bool {
+	req.RemoteAddr = s.connect.RemoteAddr
+	continued := expectContinue(req, s.conn)
+	// removeProxyHeaders resets req.Close, which tells whether the client closes
+	closeClient := req.Close
+	reqCtx, cancel := context.WithCancel(s.client.ctx)
+	s.eof = watchClient(s.r, req, cancel)
+	ctx.context, ctx.Timeouts, ctx.Retry, ctx.Upstream = reqCtx, s.timeouts, s.retry, s.upstream
+	ctx.ConnectReq = s.connect
+	req = req.WithContext(reqCtx)
+	u, err := url.Parse(s.scheme + "://" + s.connect.Host + req.URL.String())
+	if err != nil {
+		ctx.Warnf("Illegal URL %s", s.scheme+"://"+s.connect.Host+req.URL.Path)
+		ctx.Req, ctx.Error = req, &ProxyError{ErrorBadRequest, err}
+		resp := proxy.errorResponse(req, ctx)
+		resp.Close = true
+		writeMitmResponse(s.conn, req, resp, true)
+		return false
+	}
+	req.URL = u
+	proxy.addForwarded(req, ctx, s.scheme)
+	req, resp := proxy.filterRequest(req, ctx)
+	var upstream net.Conn
+	failed := false
+	if resp == nil {
+		removeProxyHeaders(ctx, req)
+		if resp = maxForwardsResponse(req); resp != nil {
+			closeRequestBody(req)
+		}
+	}
+	if resp == nil {
+		if isUpgradeRequest(req) {
+			resp, upstream, err = proxy.upgradeRoundTrip(req, ctx)
+		} else {
+			resp, err = ctx.RoundTrip(req)
+		}
+		if err != nil {
+			ctx.Warnf("Cannot read response from mitm'd server %v: %v", req.URL.Host, err)
+			resp, failed = proxy.failedResponse(req, ctx, err), true
+		} else {
+			proxy.forwardResponse(resp)
+			decodeResponse(resp, ctx)
+		}
+		ctx.Logf("resp %v", resp.Status)
+	}
+	origBody := resp.Body
+	if !failed {
+		resp = proxy.filterResponse(resp, ctx)
+	}
+	if upstream != nil {
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			switchProtocols(ctx, req, &bufferedConn{s.conn, s.r}, upstream, resp)
+			return false
+		}
+		upstream.Close()
+	}
+	if continued != nil && !continued.finish() {
+		resp.Close = true
+	}
+	resp.Close = resp.Close || closeClient
+	closeConn, err := writeMitmResponse(s.conn, ctx.Req, resp, encodeResponse(resp, origBody, ctx))
+	if err != nil {
+		// part of the response may have been sent, so the client can only be hung up on
+		ctx.Error = err
+		ctx.Warnf("Cannot write response to mitm'd client: %v", err)
+		return false
+	}
+	cancel()
+	return !closeConn
+}
+
+// filterConnect runs the CONNECT handlers, until one of them returns an action. It returns
+// false if a handler panicked.
+func (proxy *ProxyHttpServer) filterConnect(host string, ctx *ProxyCtx) (todo *ConnectAction, newhost string, ok bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			proxy.recovered(ctx, v)
+			ok = false
+		}
+	}()
+	httpsHandlers := proxy.handlers.load().https
+	ctx.Logf("Running %d CONNECT handlers", len(httpsHandlers))
+	todo = OkConnect
+	for i, h := range httpsHandlers {
+		newtodo, newhost := h.HandleConnect(host, ctx)
+
+		// If found a result, break the loop immediately
+		if newtodo != nil {
+			todo, host = newtodo, newhost
+			ctx.Logf("on %dth handler: %v %s", i, todo, host)
+			break
+		}
+	}
+	return todo, host, true
+}
+
+// watchClient peeks at the client connection while a request is served, and calls cancel
+// if the client hangs up. The result of the peek is sent on the returned channel, see
+// nextIsEof. Requests with a body, or upgrade requests, are not watched, since their
+// connection is still to be read.
+func watchClient(r *bufio.Reader, req *http.Request, cancel func()) <-chan bool {
+	if (req.Body != nil && req.Body != http.NoBody) || isUpgradeRequest(req) {
+		return nil
+	}
+	eof := make(chan bool, 1)
+	go func() {
+		_, err := r.Peek(1)
+		if err != nil {
+			cancel()
+		}
+		eof <- err == io.EOF
+	}()
+	return eof
+}
+
+// nextIsEof is like isEof, but waits for the peek of watchClient, if any
+func nextIsEof(r *bufio.Reader, eof <-chan bool) bool {
+	if eof != nil {
+		return <-eof
+	}
+	return isEof(r)
+}
+
+// writeMitmResponse writes resp to a man in the middle'd client, which sent req, following
+// the HTTP/1.1 message framing rules, as http.ResponseWriter does in ServeHTTP.
+// Content-Length is kept if the body was not modified, otherwise the body is chunked,
+// followed by the trailers of resp. It reports whether the client connection must be
+// closed after the response.
+func writeMitmResponse(w io.Writer, req *http.Request, resp *http.Response, bodyModified bool) (bool, error) {
+	r := *resp
+	r.Request = req
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/1.1", 1, 1
+	r.Header = resp.Header.Clone()
+	r.Close = req.Close || resp.Close || headerHasToken(resp.Header, "Connection", "close")
+	r.Header.Del("Connection")
+	r.TransferEncoding = nil
+	if r.Body == nil {
+		r.Body = http.NoBody
+	}
+	if !hasBody(&r) {
+		// the Content-Length of a response to HEAD is the one of the response to GET
+		if req.Method != "HEAD" {
+			r.ContentLength = 0
+		}
+		r.Body.Close()
+		r.Body = http.NoBody
+	} else {
+		if bodyModified || (r.ContentLength == 0 && r.Body != http.NoBody) {
+			r.ContentLength = -1
+		}
+		if req.ProtoAtLeast(1, 1) && (r.ContentLength < 0 || len(r.Trailer) > 0) {
+			// trailers can only be sent with a chunked body
+			r.ContentLength = -1
+			r.TransferEncoding = []string{"chunked"}
+		} else if r.ContentLength < 0 {
+			// the end of the body is told by closing the connection
+			r.Close = true
+		}
+	}
+	return r.Close, r.Write(w)
+}
+
+// connTransport sends the requests of a plain HTTP man in the middle'd session to the
+// destination of the CONNECT over the connection dialed for it, like an http.Transport
+// keeping a single idle connection. Requests sent while the connection is busy, or once
+// it was closed, get a connection of their own.
+type connTransport struct {
+	// host is the host of the requests sent by the transport, and addr the address dialed
+	// for them
+	host, addr string
+	dial       func(network, addr string) (net.Conn, error)
+	timeout    time.Duration
+	mu         sync.Mutex
+	idle       *bufferedConn
+	closed     bool
+}
+
+func newConnTransport(host, addr string, c net.Conn, dial func(network, addr string) (net.Conn, error), timeout time.Duration) *connTransport {
+	return &connTransport{host: host, addr: addr, dial: dial, timeout: timeout,
+		idle: &bufferedConn{c, bufio.NewReader(c)}}
+}
+
+// serves reports whether req is sent by t, which is nil outside of plain HTTP man in the
+// middle'd sessions
+func (t *connTransport) serves(req *http.Request) bool {
+	return t != nil && req.URL.Scheme == "http" && req.URL.Host == t.host
+}
+
+// take returns a connection to the destination, which the caller owns, and whether it is
+// the idle connection
+func (t *connTransport) take() (*bufferedConn, bool, error) {
+	t.mu.Lock()
+	c := t.idle
+	t.idle = nil
+	t.mu.Unlock()
+	if c != nil {
+		return c, true, nil
+	}
+	nc, err := dialTimeout(t.dial, "tcp", t.addr, t.timeout)
+	if err != nil {
+		return nil, false, err
+	}
+	return &bufferedConn{nc, bufio.NewReader(nc)}, false, nil
+}
+
+// put makes c the idle connection, unless there is one already or t is closed
+func (t *connTransport) put(c *bufferedConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.idle != nil || t.closed {
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	t.idle = c
+}
+
+// Close closes the idle connection, and the connections in use once they are released
+func (t *connTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	if t.idle != nil {
+		t.idle.Close()
+		t.idle = nil
+	}
+	return nil
+}
+
+// RoundTrip sends req, honoring its context and its client trace as http.Transport does,
+// so that the timeouts of the request apply, see Timeouts.roundTrip
+func (t *connTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c, reused, err := t.take()
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(req.Context(), func() { c.SetDeadline(time.Unix(1, 0)) })
+	resp, err := t.send(c, req)
+	if err != nil && reused && !hasReqBody(req) && req.Context().Err() == nil {
+		// the server may have closed the idle connection meanwhile
+		stop()
+		c.Close()
+		if c, _, err = t.take(); err != nil {
+			return nil, err
+		}
+		stop = context.AfterFunc(req.Context(), func() { c.SetDeadline(time.Unix(1, 0)) })
+		resp, err = t.send(c, req)
+	}
+	if err != nil {
+		stop()
+		c.Close()
+		if cerr := req.Context().Err(); cerr != nil {
+			err = cerr
+		}
+		return nil, err
+	}
+	resp.Body = &connBody{ReadCloser: resp.Body, t: t, c: c, stop: stop, eof: resp.Body == http.NoBody,
+		reuse: !req.Close && !resp.Close && resp.StatusCode != http.StatusSwitchingProtocols}
+	return resp, nil
+}
+
+// send writes req to c and reads its response, skipping interim responses: the client was
+// sent 100 Continue already if it asked
+func (t *connTransport) send(c *bufferedConn, req *http.Request) (*http.Response, error) {
+	trace := httptrace.ContextClientTrace(req.Context())
+	if err := req.Write(c); err != nil {
+		return nil, err
+	}
+	if trace != nil && trace.WroteRequest != nil {
+		trace.WroteRequest(httptrace.WroteRequestInfo{})
+	}
+	if _, err := c.r.Peek(1); err != nil {
+		return nil, err
+	}
+	if trace != nil && trace.GotFirstResponseByte != nil {
+		trace.GotFirstResponseByte()
+	}
+	for {
+		resp, err := http.ReadResponse(c.r, req)
+		if err != nil || resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, err
+		}
+	}
+}
+
+// connBody is the body of a response of connTransport, whose connection is released once
+// the body is read entirely and closed, or closed otherwise
+type connBody struct {
+	io.ReadCloser
+	t     *connTransport
+	c     *bufferedConn
+	stop  func() bool
+	reuse bool
+	eof   bool
+	once  sync.Once
+}
+
+func (b *connBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *connBody) Close() error {
+	var err error
+	b.once.Do(func() {
+		if !b.eof {
+			// or closing the body would read what is left of it
+			b.c.Close()
+		}
+		err = b.ReadCloser.Close()
+		// the connection can't be reused if the request was cancelled meanwhile
+		if b.stop() && b.reuse && b.eof {
+			b.t.put(b.c)
+		} else {
+			b.c.Close()
+		}
+	})
+	return err
+}
+
+// httpError sets err in ctx.Error, responds to the request in ctx.Req with the error response,
+// and closes the client connection
+func (proxy *ProxyHttpServer) httpError(w io.WriteCloser, ctx *ProxyCtx, kind ErrorKind, err error) {
+	ctx.Error = newProxyError(kind, err)
+	resp := proxy.errorResponse(ctx.Req, ctx)
+	resp.Close = true
+	if _, err := writeMitmResponse(w, ctx.Req, resp, true); err != nil {
 		ctx.Warnf("Error responding to client: %s", err)
 	}
 	if err := w.Close(); err != nil {
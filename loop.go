@@ -0,0 +1,165 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrLoopDetected is the error of a request the proxy would send back to itself, directly
+// or through other proxies. The client gets a 508 Loop Detected response.
+var ErrLoopDetected = errors.New("request loops back to the proxy")
+
+// defaultNonproxyHandler answers the requests addressed to the proxy itself when
+// NonproxyHandler is nil
+var defaultNonproxyHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	http.Error(w, "This is a proxy server. Does not respond to non-proxy requests.", http.StatusInternalServerError)
+})
+
+// listenerAddrs holds the addresses the proxy is listening on, as learned from the local
+// address of the connections of its clients
+type listenerAddrs struct {
+	mu sync.RWMutex
+	// ips are the addresses listened on by port
+	ips map[string][]net.IP
+}
+
+// add learns the address r was received on, if it was served by net/http
+func (l *listenerAddrs) add(r *http.Request) {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	port := strconv.Itoa(addr.Port)
+	l.mu.RLock()
+	known := containsIP(l.ips[port], addr.IP)
+	l.mu.RUnlock()
+	if known {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ips == nil {
+		l.ips = make(map[string][]net.IP)
+	}
+	if !containsIP(l.ips[port], addr.IP) {
+		l.ips[port] = append(l.ips[port], addr.IP)
+	}
+}
+
+// isSelf reports whether hostport is the address of one of the listeners. Host names other
+// than localhost are not resolved, the connections to them are checked once dialed instead,
+// see checkDialed.
+func (l *listenerAddrs) isSelf(hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	l.mu.RLock()
+	listening := l.ips[port]
+	l.mu.RUnlock()
+	if len(listening) == 0 {
+		return false
+	}
+	var ips []net.IP
+	switch ip := net.ParseIP(strings.Trim(host, "[]")); {
+	case ip != nil:
+		ips = []net.IP{ip}
+	case strings.EqualFold(host, "localhost"):
+		ips = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	for _, ip := range ips {
+		for _, self := range listening {
+			if ip.Equal(self) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostPort returns the host and port u is dialed on
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// viaToken identifies this instance of the proxy in the Via headers it adds, so that it
+// recognizes the requests it already forwarded
+func (proxy *ProxyHttpServer) viaToken() string {
+	proxy.tokenOnce.Do(func() {
+		b := make([]byte, 8)
+		rand.Read(b)
+		proxy.token = hex.EncodeToString(b)
+	})
+	return proxy.token
+}
+
+// loopsBack reports whether req went through the proxy already, as told by the Via header
+// it adds if AddVia is set
+func (proxy *ProxyHttpServer) loopsBack(req *http.Request) bool {
+	token := "(" + proxy.viaToken() + ")"
+	for _, v := range req.Header["Via"] {
+		if strings.Contains(v, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendsToSelf reports whether sending req would connect to one of the proxy's listeners,
+// either because it is its destination, or the upstream proxy it is sent through. Only the
+// addresses which need no lookup are known to be the proxy's here, the connections of Tr
+// being checked once dialed, see checkedDial.
+func (proxy *ProxyHttpServer) sendsToSelf(req *http.Request, ctx *ProxyCtx) bool {
+	u := req.URL
+	if ctx.RoundTripper == nil && proxy.Tr != nil && proxy.Tr.Proxy != nil {
+		if p, err := proxy.Tr.Proxy(req); err == nil && p != nil {
+			u = p
+		}
+	}
+	return proxy.listeners.isSelf(hostPort(u))
+}
+
+// checkDialed fails with ErrLoopDetected if c, dialed by the proxy, is connected to one of
+// its listeners
+func (proxy *ProxyHttpServer) checkDialed(c net.Conn) (net.Conn, error) {
+	if proxy.listeners.isSelf(c.RemoteAddr().String()) {
+		c.Close()
+		return nil, &ProxyError{ErrorLoop, ErrLoopDetected}
+	}
+	return c, nil
+}
+
+// checkedDial returns dial, checking the connections it dials with checkDialed. It is the
+// DialContext of the default Tr.
+func (proxy *ProxyHttpServer) checkedDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return proxy.checkDialed(c)
+	}
+}
@@ -0,0 +1,52 @@
+package goproxy
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// PanicError is the error of a handler which panicked. It is set in ctx.Error wrapped in a
+// ProxyError of kind ErrorHandlerPanic.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprint("panic: ", e.Value)
+}
+
+// recovered reports v, the value of a panic recovered while serving ctx, to PanicHandler,
+// and sets it in ctx.Error. http.ErrAbortHandler, which handlers panic with to abort the
+// response, is not reported.
+func (proxy *ProxyHttpServer) recovered(ctx *ProxyCtx, v interface{}) *ProxyError {
+	stack := debug.Stack()
+	if v != http.ErrAbortHandler {
+		if proxy.PanicHandler != nil {
+			proxy.PanicHandler(ctx, v, stack)
+		} else {
+			ctx.Warnf("Recovered panic: %v\n%s", v, stack)
+		}
+	}
+	err := &ProxyError{ErrorHandlerPanic, &PanicError{v, stack}}
+	ctx.Error = err
+	return err
+}
+
+// recoverGoroutine is deferred by the goroutines of the proxy, so that a panic would only
+// end the session it happened in. The connections of the session should be closed by
+// other deferred calls.
+func (proxy *ProxyHttpServer) recoverGoroutine(ctx *ProxyCtx) {
+	if v := recover(); v != nil {
+		proxy.recovered(ctx, v)
+	}
+}
+
+// goFunc runs f in a new goroutine that Shutdown waits for, recovering its panics
+func (proxy *ProxyHttpServer) goFunc(ctx *ProxyCtx, f func()) {
+	proxy.sessions.goFunc(func() {
+		defer proxy.recoverGoroutine(ctx)
+		f()
+	})
+}
@@ -8,7 +8,9 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // The basic proxy type. Implements http.Handler.
@@ -17,16 +19,75 @@ type ProxyHttpServer struct {
 	// see http://golang.org/src/pkg/sync/atomic/doc.go#L41
 	sess int64
 	// setting Verbose to true will log information on each request sent to the proxy
-	Verbose         bool
-	Logger          *log.Logger
+	Verbose bool
+	Logger  *log.Logger
+	// NonproxyHandler will be used for non-proxy requests (requests with a relative URI)
+	// that do not match any route in Routes, and for proxy requests addressed to the proxy
+	// itself, so that admin pages can be served on the proxy port. If nil, non-proxy
+	// requests are passed through the handlers as is, and the handlers are expected to
+	// direct them somewhere; those which they don't get an error response.
 	NonproxyHandler http.Handler
-	reqHandlers     []ReqHandler
-	respHandlers    []RespHandler
-	httpsHandlers   []HttpsHandler
-	Tr              *http.Transport
+	// Routes is used to send non-proxy requests to upstream servers, see Route
+	Routes *RoutingTable
+	// Pools are the pools of servers requests can be spread across, see Pool
+	Pools *Pools
+	// Breakers, if not nil, fail fast the requests to failing upstreams, see Breakers
+	Breakers *Breakers
+	// handlers holds the registered handlers, see Handle
+	handlers handlerRegistry
+	Tr       *http.Transport
 	// ConnectDial will be used to create TCP connections for CONNECT requests
 	// if nil Tr.Dial will be used
 	ConnectDial func(network string, addr string) (net.Conn, error)
+	// MitmHTTP2 allows clients of man in the middle connections to use HTTP/2, if they
+	// support it. Every HTTP/2 stream is handled as a separate request. Off by default.
+	MitmHTTP2 bool
+	// ErrorHandler, if not nil, renders the response sent to the client when the proxy
+	// fails to serve a request, whether it was sent directly to the proxy or through a
+	// man in the middle'd connection, and when it fails to connect a CONNECT tunnel.
+	// If it is nil or returns nil, a text/plain response with the status of err is sent.
+	//	proxy.ErrorHandler = func(req *http.Request, ctx *goproxy.ProxyCtx, err *goproxy.ProxyError) *http.Response {
+	//		if err.Kind == goproxy.ErrorDNS {
+	//			return goproxy.NewResponse(req, goproxy.ContentTypeHtml, http.StatusBadGateway, noSuchHostPage)
+	//		}
+	//		return nil
+	//	}
+	ErrorHandler func(req *http.Request, ctx *ProxyCtx, err *ProxyError) *http.Response
+	// PanicHandler, if not nil, is called with the value and the stack of the panics
+	// recovered in handlers, and in the goroutines serving hijacked connections. ctx.Session
+	// tells which session panicked. The request gets the error response of ErrorHandler, or,
+	// if the response was already being sent, the client connection is closed. By default
+	// the panics are logged.
+	PanicHandler func(ctx *ProxyCtx, v interface{}, stack []byte)
+	// AddVia adds a Via header to the requests and responses forwarded by the proxy, with
+	// the pseudonym ViaName, "goproxy" if empty. Its entry is commented with a token unique
+	// to the proxy, so that requests looping back to it through other proxies get a
+	// 508 Loop Detected response. Requests the proxy would send to its own listeners get
+	// it as well, whether AddVia is set or not, though only the connections dialed by the
+	// default Tr, CONNECT and upgrade requests are checked when their destination is a
+	// host name.
+	AddVia  bool
+	ViaName string
+	// AddForwarded adds the Forwarded, X-Forwarded-For, X-Forwarded-Host and
+	// X-Forwarded-Proto headers to the requests forwarded by the proxy, telling the
+	// destination server about the client
+	AddForwarded bool
+	// Timeouts bounds each phase of proxying, see Timeouts. No timeouts by default.
+	Timeouts Timeouts
+	// Retry, if not nil, is the policy retrying the requests which failed, see RetryPolicy
+	Retry *RetryPolicy
+	// CoalesceDir is the directory where Coalesce spools the shared bodies too large to be
+	// kept in memory, os.TempDir() if empty
+	CoalesceDir string
+	// sessions tracks the hijacked connections, see Shutdown
+	sessions sessionTracker
+	// listeners are the addresses the proxy is reached on, see sendsToSelf
+	listeners listenerAddrs
+	// shapedTransports are the clones of Tr shaping the upstream connections
+	shapedTransports shapedTransports
+	// token identifies the proxy in Via headers, see viaToken
+	token     string
+	tokenOnce sync.Once
 }
 
 var hasPort = regexp.MustCompile(`:\d+$`)
@@ -42,6 +103,52 @@ func copyHeaders(dst, src http.Header) {
 	}
 }
 
+// announceTrailers declares the trailers that will follow the body in the Trailer header
+func announceTrailers(h, trailer http.Header) {
+	for k := range trailer {
+		h.Add("Trailer", k)
+	}
+}
+
+// copyTrailers sets the trailers of a response already written with an http.ResponseWriter
+func copyTrailers(h, trailer http.Header) {
+	for k, vs := range trailer {
+		for _, v := range vs {
+			h.Add(http.TrailerPrefix+k, v)
+		}
+	}
+}
+
+// copyResponseBody copies the body of resp to w. Bodies of unknown length, such as
+// streamed responses, are flushed to the client as data arrives.
+func copyResponseBody(w http.ResponseWriter, resp *http.Response) (int64, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || resp.ContentLength >= 0 {
+		return io.Copy(w, resp.Body)
+	}
+	return io.Copy(flushWriter{w, flusher}, resp.Body)
+}
+
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	fw.f.Flush()
+	return n, err
+}
+
+// hasBody reports whether resp may have a body, per RFC 7230 section 3.3.3
+func hasBody(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == "HEAD" {
+		return false
+	}
+	return resp.StatusCode >= 200 && resp.StatusCode != http.StatusNoContent &&
+		resp.StatusCode != http.StatusNotModified
+}
+
 func isEof(r *bufio.Reader) bool {
 	_, err := r.Peek(1)
 	if err == io.EOF {
@@ -52,7 +159,26 @@ func isEof(r *bufio.Reader) bool {
 
 func (proxy *ProxyHttpServer) filterRequest(r *http.Request, ctx *ProxyCtx) (req *http.Request, resp *http.Response) {
 	req = r
-	for _, h := range proxy.reqHandlers {
+	ctx.Req, ctx.Attempts = r, nil
+	defer func() {
+		if v := recover(); v != nil {
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			proxy.recovered(ctx, v)
+			req, resp = r, proxy.errorResponse(r, ctx)
+		}
+		if resp != nil {
+			// the handlers change r in place, whose body is not sent
+			closeRequestBody(r)
+		}
+	}()
+	if ctx.looped {
+		ctx.Warnf("Request %v %v loops back to the proxy", r.Method, r.URL)
+		ctx.Error = &ProxyError{ErrorLoop, ErrLoopDetected}
+		return r, proxy.errorResponse(r, ctx)
+	}
+	for _, h := range proxy.handlers.load().req {
 		req, resp = h.Handle(r, ctx)
 		// non-nil resp means the handler decided to skip sending the request
 		// and return canned response instead.
@@ -64,7 +190,19 @@ func (proxy *ProxyHttpServer) filterRequest(r *http.Request, ctx *ProxyCtx) (req
 }
 func (proxy *ProxyHttpServer) filterResponse(respOrig *http.Response, ctx *ProxyCtx) (resp *http.Response) {
 	resp = respOrig
-	for _, h := range proxy.respHandlers {
+	defer func() {
+		if v := recover(); v != nil {
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			proxy.recovered(ctx, v)
+			if respOrig != nil {
+				respOrig.Body.Close()
+			}
+			resp = proxy.errorResponse(ctx.Req, ctx)
+		}
+	}()
+	for _, h := range proxy.handlers.load().resp {
 		ctx.Resp = resp
 		resp = h.Handle(resp, ctx)
 	}
@@ -74,81 +212,167 @@ func (proxy *ProxyHttpServer) filterResponse(respOrig *http.Response, ctx *Proxy
 func removeProxyHeaders(ctx *ProxyCtx, r *http.Request) {
 	r.RequestURI = "" // this must be reset when serving a request with the client
 	ctx.Logf("Sending request %v %v", r.Method, r.URL.String())
-	// If no Accept-Encoding header exists, Transport will add the headers it can accept
-	// and would wrap the response body with the relevant reader.
-	r.Header.Del("Accept-Encoding")
-	// curl can add that, see
-	// http://homepage.ntlworld.com/jonathan.deboynepollard/FGA/web-proxy-connection-header.html
-	r.Header.Del("Proxy-Connection")
+	// The proxy decodes the response for the handlers, and encodes it for the client.
+	// Since Accept-Encoding is set, the Transport won't decode it on its own.
+	negotiateEncoding(r, ctx)
 	// Connection is single hop Header:
 	// http://www.w3.org/Protocols/rfc2616/rfc2616.txt
 	// 14.10 Connection
 	//   The Connection general-header field allows the sender to specify
 	//   options that are desired for that particular connection and MUST NOT
 	//   be communicated by proxies over further connections.
-	r.Header.Del("Connection")
+	// Upgrade is hop-by-hop as well, but we tunnel the upgraded connection to the
+	// destination server, so it has to agree to switch protocols.
+	removeHopHeaders(r.Header, isUpgradeRequest(r))
+	// or the Transport would send Connection: close
+	r.Close = false
 }
 
 // Standard net/http function. Shouldn't be used directly, http.Serve will use it.
 func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//r.Header["X-Forwarded-For"] = w.RemoteAddr()
+	proxy.listeners.add(r)
 	if r.Method == "CONNECT" {
 		log.Println("handle connect")
 		proxy.handleHttps(w, r)
 	} else {
-		ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), proxy: proxy}
+		reqCtx, cancel := proxy.sessions.newContext(r.Context())
+		defer cancel()
+		r = r.WithContext(reqCtx)
+		ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), proxy: proxy,
+			context: reqCtx, Timeouts: proxy.Timeouts, Retry: proxy.Retry}
+
+		if !r.URL.IsAbs() {
+			if ctx.Route = proxy.Routes.Match(r); ctx.Route == nil && proxy.NonproxyHandler != nil {
+				proxy.NonproxyHandler.ServeHTTP(w, r)
+				return
+			}
+		} else if proxy.listeners.isSelf(hostPort(r.URL)) {
+			ctx.Logf("Serving request to the proxy itself %v", r.URL)
+			proxy.nonproxyHandler().ServeHTTP(w, r)
+			return
+		}
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		proxy.addForwarded(r, ctx, scheme)
+		if ctx.Route != nil {
+			ctx.Logf("Routing %v %v to %v", r.Host, r.URL.Path, ctx.Route.Upstream)
+			ctx.Route.rewrite(r)
+		}
+
+		proxy.handleHttp(w, r, ctx)
+	}
+}
 
-		var err error
-		ctx.Logf("Got request %v %v %v %v", r.URL.Path, r.Host, r.Method, r.URL.String())
-		r, resp := proxy.filterRequest(r, ctx)
+// handleHttp filters the request through the handlers, sends it to its destination
+// and writes the filtered response to w.
+func (proxy *ProxyHttpServer) handleHttp(w http.ResponseWriter, r *http.Request, ctx *ProxyCtx) {
+	var err error
+	var upstream net.Conn
+	ctx.Logf("Got request %v %v %v %v", r.URL.Path, r.Host, r.Method, r.URL.String())
+	r, resp := proxy.filterRequest(r, ctx)
+	failed := false
 
-		if resp == nil {
-			removeProxyHeaders(ctx, r)
-			resp, err = ctx.RoundTrip(r)
+	if resp == nil && !r.URL.IsAbs() {
+		// no handler directed the non-proxy request anywhere
+		proxy.nonproxyHandler().ServeHTTP(w, r)
+		return
+	}
+	if resp == nil {
+		removeProxyHeaders(ctx, r)
+		r = r.WithContext(ctx.Context())
+		if resp = maxForwardsResponse(r); resp != nil {
+			ctx.Logf("Answering %v with Max-Forwards: 0", r.Method)
+			closeRequestBody(r)
+		} else {
+			if p := ctx.Network; p != nil && !ctx.shaped {
+				leg := p.leg()
+				sleepUntil(time.Now().Add(leg.delay()), ctx.Context().Done())
+				r.Body = shapeBody(ctx.Context(), r.Body, leg, leg.Up)
+			}
+			if isUpgradeRequest(r) {
+				resp, upstream, err = proxy.upgradeRoundTrip(r, ctx)
+			} else {
+				resp, err = ctx.RoundTrip(r)
+			}
 			if err != nil {
-				ctx.Error = err
-				resp = proxy.filterResponse(nil, ctx)
-				if resp == nil {
-					ctx.Logf("error read response %v %v:", r.URL.Host, err.Error())
-					http.Error(w, err.Error(), 500)
-					return
-				}
+				ctx.Logf("error read response %v %v:", r.URL.Host, err.Error())
+				resp, failed = proxy.failedResponse(r, ctx, err), true
+			} else {
+				proxy.forwardResponse(resp)
+				decodeResponse(resp, ctx)
 			}
 			ctx.Logf("Received response %v", resp.Status)
 		}
-		origBody := resp.Body
+	}
+	origBody := resp.Body
+	if !failed {
 		resp = proxy.filterResponse(resp, ctx)
+	}
 
-		ctx.Logf("Copying response to client %v [%d]", resp.Status, resp.StatusCode)
-		// http.ResponseWriter will take care of filling the correct response length
-		// Setting it now, might impose wrong value, contradicting the actual new
-		// body the user returned.
-		// We keep the original body to remove the header only if things changed.
-		// This will prevent problems with HEAD requests where there's no body, yet,
-		// the Content-Length header should be set.
-		if origBody != resp.Body {
-			resp.Header.Del("Content-Length")
+	if upstream != nil {
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			proxy.serveUpgraded(w, r, resp, upstream, ctx)
+			return
 		}
-		copyHeaders(w.Header(), resp.Header)
-		w.WriteHeader(resp.StatusCode)
-		nr, err := io.Copy(w, resp.Body)
-		if err := resp.Body.Close(); err != nil {
-			ctx.Warnf("Can't close response body %v", err)
-		}
-		ctx.Logf("Copied %v bytes to client error=%v", nr, err)
+		// a handler refused the upgrade
+		upstream.Close()
+	}
+
+	ctx.Logf("Copying response to client %v [%d]", resp.Status, resp.StatusCode)
+	// http.ResponseWriter will take care of filling the correct response length
+	// Setting it now, might impose wrong value, contradicting the actual new
+	// body the user returned.
+	// We keep the original body to remove the header only if things changed.
+	// This will prevent problems with HEAD requests where there's no body, yet,
+	// the Content-Length header should be set.
+	if encodeResponse(resp, origBody, ctx) {
+		resp.Header.Del("Content-Length")
+	}
+	if p := ctx.Network; p != nil && !ctx.shaped {
+		leg := p.leg()
+		sleepUntil(time.Now().Add(leg.delay()), ctx.Context().Done())
+		resp.Body = shapeBody(ctx.Context(), resp.Body, leg, leg.Down)
+	}
+	copyHeaders(w.Header(), resp.Header)
+	announceTrailers(w.Header(), resp.Trailer)
+	w.WriteHeader(resp.StatusCode)
+	nr, err := copyResponseBody(w, resp)
+	if err := resp.Body.Close(); err != nil {
+		ctx.Warnf("Can't close response body %v", err)
+	}
+	copyTrailers(w.Header(), resp.Trailer)
+	ctx.Logf("Copied %v bytes to client error=%v", nr, err)
+	if err != nil {
+		ctx.Error = err
+		// the client must not take the partial body as the complete response
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// nonproxyHandler returns the handler of the requests addressed to the proxy itself
+func (proxy *ProxyHttpServer) nonproxyHandler() http.Handler {
+	if proxy.NonproxyHandler != nil {
+		return proxy.NonproxyHandler
 	}
+	return defaultNonproxyHandler
 }
 
 // New proxy server, logs to StdErr by default
 func NewProxyHttpServer() *ProxyHttpServer {
 	proxy := ProxyHttpServer{
-		Logger:        log.New(os.Stderr, "", log.LstdFlags),
-		reqHandlers:   []ReqHandler{},
-		respHandlers:  []RespHandler{},
-		httpsHandlers: []HttpsHandler{},
-		Tr: &http.Transport{TLSClientConfig: tlsClientSkipVerify,
-			Proxy: http.ProxyFromEnvironment},
+		Logger: log.New(os.Stderr, "", log.LstdFlags),
+		Routes: NewRoutingTable(),
+		Pools:  NewPools(),
+		// the request body is only read once the server agrees with 100 Continue, which the
+		// client is then sent as well
+		Tr: &http.Transport{TLSClientConfig: tlsClientSkipVerify.Clone(),
+			Proxy: http.ProxyFromEnvironment, ForceAttemptHTTP2: true,
+			ExpectContinueTimeout: time.Second},
 	}
+	proxy.Tr.DialContext = proxy.checkedDial((&net.Dialer{}).DialContext)
 	proxy.ConnectDial = dialerFromEnv(&proxy)
 	return &proxy
 }
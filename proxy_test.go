@@ -3,9 +3,14 @@ package goproxy_test
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"image"
 	"io"
 	"io/ioutil"
@@ -15,8 +20,12 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/marbemac/goproxy"
 	"github.com/marbemac/goproxy/ext/image"
@@ -737,14 +746,100 @@ func TestCurlMinusP(t *testing.T) {
 	}
 }
 
-// func TestSelfRequest(t *testing.T) {
-// 	proxy := goproxy.NewProxyHttpServer()
-// 	_, l := oneShotProxy(proxy, t)
-// 	defer l.Close()
-// 	if !strings.Contains(string(getOrFail(l.URL, http.DefaultClient, t)), "non-proxy") {
-// 		t.Fatal("non proxy requests should fail")
-// 	}
-// }
+func TestSelfRequest(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	if !strings.Contains(string(getOrFail(l.URL, http.DefaultClient, t)), "non-proxy") {
+		t.Fatal("non proxy requests should fail")
+	}
+}
+
+func TestProxyRequestToSelf(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.NonproxyHandler = ConstantHanlder("admin")
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	if resp := string(getOrFail(l.URL+"/status", client, t)); resp != "admin" {
+		t.Error("proxy requests to the proxy itself should reach the NonproxyHandler, got", resp)
+	}
+}
+
+func TestLoopDetection(t *testing.T) {
+	expectLoop := func(client *http.Client, name string) {
+		resp, err := client.Get(srv.URL + "/bobo")
+		fatalOnErr(err, name, t)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusLoopDetected {
+			t.Errorf("%v should be detected as a loop, got %v", name, resp.Status)
+		}
+	}
+
+	// the proxy is its own upstream proxy
+	proxy := goproxy.NewProxyHttpServer()
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	proxyUrl, _ := url.Parse(l.URL)
+	proxy.Tr = &http.Transport{Proxy: http.ProxyURL(proxyUrl)}
+	expectLoop(client, "request sent through itself")
+
+	// two proxies sending requests through each other
+	a, b := goproxy.NewProxyHttpServer(), goproxy.NewProxyHttpServer()
+	a.AddVia, b.AddVia = true, true
+	var errs []*goproxy.ProxyError
+	var mu sync.Mutex
+	a.ErrorHandler = func(req *http.Request, ctx *goproxy.ProxyCtx, err *goproxy.ProxyError) *http.Response {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+		return nil
+	}
+	clientA, la := oneShotProxy(a, t)
+	defer la.Close()
+	_, lb := oneShotProxy(b, t)
+	defer lb.Close()
+	urlA, _ := url.Parse(la.URL)
+	urlB, _ := url.Parse(lb.URL)
+	a.Tr = &http.Transport{Proxy: http.ProxyURL(urlB)}
+	b.Tr = &http.Transport{Proxy: http.ProxyURL(urlA)}
+	expectLoop(clientA, "request looping through another proxy")
+	mu.Lock()
+	if len(errs) != 1 || errs[0].Kind != goproxy.ErrorLoop || !errors.Is(errs[0], goproxy.ErrLoopDetected) {
+		t.Error("Expected a single ErrLoopDetected error, got", errs)
+	}
+	mu.Unlock()
+
+	// CONNECT to the proxy itself
+	c, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer c.Close()
+	fmt.Fprintf(c, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", proxyUrl.Host, proxyUrl.Host)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	fatalOnErr(err, "read CONNECT response", t)
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Error("CONNECT to the proxy itself should be detected as a loop, got", resp.Status)
+	}
+}
+
+func TestLoopDetectionByName(t *testing.T) {
+	// the connections of the default transport are checked once dialed, the host names
+	// not being looked up beforehand
+	host, _ := os.Hostname()
+	if addrs, err := net.LookupHost(host); err != nil || len(addrs) == 0 || addrs[0] != "127.0.0.1" {
+		t.Skip("the host name does not resolve to 127.0.0.1")
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	port := strconv.Itoa(l.Listener.Addr().(*net.TCPAddr).Port)
+	proxy.Tr.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: net.JoinHostPort(host, port)})
+	resp, err := client.Get(srv.URL + "/bobo")
+	fatalOnErr(err, "get", t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Error("request sent through itself by name should be detected as a loop, got", resp.Status)
+	}
+}
 
 func TestHasGoproxyCA(t *testing.T) {
 	proxy := goproxy.NewProxyHttpServer()
@@ -762,3 +857,1653 @@ func TestHasGoproxyCA(t *testing.T) {
 		t.Error("Wrong response when mitm", resp, "expected bobo")
 	}
 }
+
+func TestReverseProxyRoutes(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.NonproxyHandler = ConstantHanlder("non-proxy")
+	if _, err := proxy.Routes.Add("api.example.com", "/api", srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	route, err := proxy.Routes.Add("api.example.com", "/api/v2", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route.StripPrefix = true
+	handled := false
+	proxy.OnRequest(goproxy.DstHostIs(srv.Listener.Addr().String())).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		handled = ctx.Route != nil
+		return req, nil
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	get := func(host, path string) string {
+		req, err := http.NewRequest("GET", s.URL+path, nil)
+		fatalOnErr(err, "NewRequest", t)
+		req.Host = host
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		fatalOnErr(err, "RoundTrip", t)
+		defer resp.Body.Close()
+		return string(readAll(resp.Body, t))
+	}
+	if resp := get("api.example.com", "/api/v2/bobo"); resp != "bobo" {
+		t.Error("longest prefix should be stripped and routed upstream, got", resp)
+	}
+	if !handled {
+		t.Error("routed requests should go through the request handlers")
+	}
+	if resp := get("api.example.com", "/bobo"); resp != "non-proxy" {
+		t.Error("unrouted requests should reach the NonproxyHandler, got", resp)
+	}
+	if resp := get("www.example.com", "/api/v2/bobo"); resp != "non-proxy" {
+		t.Error("requests to other hosts should reach the NonproxyHandler, got", resp)
+	}
+	if resp := get("api.example.com", "/apibobo"); resp != "non-proxy" {
+		t.Error("prefixes should match whole path segments, got", resp)
+	}
+
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RequestURI)
+	}))
+	defer echo.Close()
+	route, err = proxy.Routes.Add("files.example.com", "/files/", echo.URL+"/store")
+	fatalOnErr(err, "Add", t)
+	route.StripPrefix = true
+	if resp := get("files.example.com", "/files/a%2Fb"); resp != "/store/a%2Fb" {
+		t.Error("the escaping of the path should be kept, got", resp)
+	}
+}
+
+// upgradeEchoHandler switches to the "echo" protocol, and echoes back everything it reads
+type upgradeEchoHandler struct{}
+
+func (upgradeEchoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "echo" || !strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		http.Error(w, "expected echo upgrade request", http.StatusBadRequest)
+		return
+	}
+	c, buf, err := w.(http.Hijacker).Hijack()
+	panicOnErr(err, "hijack")
+	defer c.Close()
+	io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	io.Copy(c, buf)
+}
+
+func upgradeAndEcho(c net.Conn, url string, t *testing.T) {
+	req, err := http.NewRequest("GET", url, nil)
+	fatalOnErr(err, "NewRequest", t)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	if strings.HasPrefix(url, "http://") {
+		err = req.WriteProxy(c)
+	} else {
+		err = req.Write(c)
+	}
+	fatalOnErr(err, "write upgrade request", t)
+	buf := bufio.NewReader(c)
+	resp, err := http.ReadResponse(buf, req)
+	fatalOnErr(err, "read upgrade response", t)
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("X-Upgraded") != "1" {
+		t.Fatal("Expected filtered 101 response, got", resp.Status, resp.Header)
+	}
+	for _, msg := range []string{"hello\n", "world\n"} {
+		io.WriteString(c, msg)
+		if echo, err := buf.ReadString('\n'); err != nil || echo != msg {
+			t.Error("Expected echo of", msg, "got", echo, err)
+		}
+	}
+}
+
+func TestUpgradeIsTunneled(t *testing.T) {
+	echo := httptest.NewServer(upgradeEchoHandler{})
+	defer echo.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		resp.Header.Set("X-Upgraded", "1")
+		return resp
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer c.Close()
+	upgradeAndEcho(c, echo.URL+"/echo", t)
+}
+
+func TestUpgradeIsTunneledWhenMitm(t *testing.T) {
+	echo := httptest.NewTLSServer(upgradeEchoHandler{})
+	defer echo.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		resp.Header.Set("X-Upgraded", "1")
+		return resp
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer c.Close()
+	creq, err := http.NewRequest("CONNECT", echo.URL, nil)
+	fatalOnErr(err, "NewRequest", t)
+	creq.Write(c)
+	resp, err := http.ReadResponse(bufio.NewReader(c), creq)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatal("Cannot CONNECT through proxy", err)
+	}
+	upgradeAndEcho(tls.Client(c, acceptAllCerts), echo.URL+"/echo", t)
+}
+
+func TestUpstreamPoolsInAllModes(t *testing.T) {
+	echo := httptest.NewServer(upgradeEchoHandler{})
+	defer echo.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return goproxy.HTTPMitmConnect, host
+	})
+	proxy.Breakers = &goproxy.Breakers{}
+	pool := goproxy.NewPool("echo", goproxy.RoundRobin())
+	_, err := pool.Add(echo.URL, 1)
+	fatalOnErr(err, "pool.Add", t)
+	proxy.Pools.Add(pool)
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Upstream = "echo"
+		return r, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		resp.Header.Set("X-Upgraded", "1")
+		return resp
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer c.Close()
+	upgradeAndEcho(c, "http://upstream.invalid/echo", t)
+	if stats := proxy.Breakers.Stats(); len(stats) != 1 || stats[0].Key != "echo" || stats[0].Requests != 1 {
+		t.Errorf("Expected the upgrade request to go through the circuit breaker of the pool, got %+v", stats)
+	}
+
+	// the requests of HTTP mitm'd sessions are sent to the pool rather than to the destination
+	// of the CONNECT
+	c, err = net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer c.Close()
+	host := srv.Listener.Addr().String()
+	io.WriteString(c, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	r := bufio.NewReader(c)
+	readConnectResponse(r)
+	io.WriteString(c, "GET /bobo HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	resp, err := http.ReadResponse(r, nil)
+	fatalOnErr(err, "read response", t)
+	if b := string(readAll(resp.Body, t)); !strings.Contains(b, "expected echo upgrade request") {
+		t.Error("Expected the HTTP mitm'd request to be sent to the pool, got", b)
+	}
+}
+
+func TestMitmHTTP2(t *testing.T) {
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Status")
+		io.WriteString(w, r.Proto)
+		w.Header().Set("X-Status", "done")
+	}))
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	get := func(proxy *goproxy.ProxyHttpServer) (resp *http.Response, body string, handled bool) {
+		proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+		proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			handled = req.URL.Scheme == "https" && req.ProtoMajor == 2
+			return req, nil
+		})
+		s := httptest.NewServer(proxy)
+		defer s.Close()
+
+		proxyUrl, _ := url.Parse(s.URL)
+		// the transport adds h2 to the NextProtos of its TLS config
+		tr := &http.Transport{TLSClientConfig: acceptAllCerts.Clone(), Proxy: http.ProxyURL(proxyUrl), ForceAttemptHTTP2: true}
+		defer tr.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: tr}).Get(h2.URL + "/")
+		fatalOnErr(err, "get through h2 mitm", t)
+		body = string(readAll(resp.Body, t))
+		resp.Body.Close()
+		return resp, body, handled
+	}
+
+	if resp, _, _ := get(goproxy.NewProxyHttpServer()); resp.ProtoMajor != 1 {
+		t.Error("client should speak HTTP/1.1 with the proxy by default, got", resp.Proto)
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.MitmHTTP2 = true
+	resp, body, handled := get(proxy)
+	if resp.ProtoMajor != 2 || !handled {
+		t.Error("client should speak HTTP/2 with the proxy, got", resp.Proto)
+	}
+	if body != "HTTP/2.0" {
+		t.Error("proxy should speak HTTP/2 with the server, got", body)
+	}
+	if resp.Trailer.Get("X-Status") != "done" {
+		t.Error("trailers should be forwarded, got", resp.Trailer)
+	}
+}
+
+func TestHandleStream(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnResponse(goproxy.UrlIs("/bobo")).Do(goproxy.HandleStream(func(r io.Reader, w io.Writer, ctx *goproxy.ProxyCtx) error {
+		b := make([]byte, 1)
+		for {
+			n, err := r.Read(b)
+			if n > 0 {
+				w.Write(bytes.ToUpper(b[:n]))
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}))
+	proxy.OnResponse(goproxy.UrlIs("/query")).Do(goproxy.HandleStream(func(r io.Reader, w io.Writer, ctx *goproxy.ProxyCtx) error {
+		io.WriteString(w, "partial")
+		return io.ErrUnexpectedEOF
+	}))
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if resp := string(getOrFail(srv.URL+"/bobo", client, t)); resp != "BOBO" {
+		t.Error("stream handler should transform the body, got", resp)
+	}
+	if b, err := get(srv.URL+"/query?result=bar", client); err == nil {
+		t.Error("failing stream handler should abort the response, got", string(b))
+	}
+}
+
+type EchoBodyHandler struct{}
+
+func (EchoBodyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Content-Length", strconv.FormatInt(r.ContentLength, 10))
+	io.Copy(w, r.Body)
+}
+
+func TestHandleRequestBody(t *testing.T) {
+	echo := httptest.NewServer(EchoBodyHandler{})
+	defer echo.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.UrlIs("/bytes")).Do(goproxy.HandleRequestBytes(func(b []byte, ctx *goproxy.ProxyCtx) []byte {
+		return append(b, " and more"...)
+	}))
+	proxy.OnRequest(goproxy.UrlIs("/unchanged")).Do(goproxy.HandleRequestBytes(func(b []byte, ctx *goproxy.ProxyCtx) []byte {
+		return b
+	}))
+	var unchanged *http.Request
+	proxy.OnRequest(goproxy.UrlIs("/unchanged")).DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		unchanged = r
+		return r, nil
+	})
+	proxy.OnRequest(goproxy.UrlIs("/stream")).Do(goproxy.HandleRequestStream(func(r io.Reader, w io.Writer, ctx *goproxy.ProxyCtx) error {
+		b := readAll(r, t)
+		_, err := w.Write(bytes.ToUpper(b))
+		return err
+	}))
+	transformed := make(chan error, 1)
+	proxy.OnRequest(goproxy.UrlIs("/answered")).Do(goproxy.HandleRequestStream(func(r io.Reader, w io.Writer, ctx *goproxy.ProxyCtx) error {
+		_, err := io.WriteString(w, "transformed ")
+		if err == nil {
+			_, err = io.Copy(w, r)
+		}
+		transformed <- err
+		return err
+	}))
+	proxy.OnRequest(goproxy.UrlIs("/answered")).DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusOK, "answered")
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for path, expected := range map[string][2]string{
+		"/bytes":  {"body and more", "13"},
+		"/stream": {"BODY", "-1"},
+	} {
+		resp, err := client.Post(echo.URL+path, "text/plain", strings.NewReader("body"))
+		fatalOnErr(err, "post", t)
+		if body := string(readAll(resp.Body, t)); body != expected[0] {
+			t.Error("Expected request body", expected[0], "got", body)
+		}
+		resp.Body.Close()
+		if cl := resp.Header.Get("X-Content-Length"); cl != expected[1] {
+			t.Error("Expected request Content-Length", expected[1], "got", cl)
+		}
+	}
+
+	resp, err := client.Get(echo.URL + "/unchanged")
+	fatalOnErr(err, "get", t)
+	resp.Body.Close()
+	if cl := unchanged.Header.Get("Content-Length"); cl != "" || unchanged.Body != http.NoBody {
+		t.Error("Expected a request without body to be left without body, got Content-Length", cl)
+	}
+
+	// the body transformer is done if the request is not sent
+	resp, err = client.Post(echo.URL+"/answered", "text/plain", strings.NewReader(strings.Repeat("body", 1<<14)))
+	fatalOnErr(err, "post", t)
+	if body := string(readAll(resp.Body, t)); body != "answered" {
+		t.Error("Expected the handler response, got", body)
+	}
+	select {
+	case <-transformed:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the body transformer to be stopped once the request was answered")
+	}
+}
+
+func TestShutdownClosesIdleMitmSessions(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected bobo through mitm, got", r)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != nil {
+		t.Error("idle mitm session should be closed on shutdown, got", err)
+	}
+	if _, err := get(https.URL+"/bobo", client); err == nil {
+		t.Error("new CONNECT sessions should be refused after shutdown")
+	}
+}
+
+func TestShutdownForceClosesTunnels(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer conn.Close()
+	buf := bufio.NewReader(conn)
+	writeConnect(conn)
+	readConnectResponse(buf)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected open tunnel to hold shutdown until the deadline, got", err)
+	}
+	if _, err := buf.ReadByte(); err == nil {
+		t.Error("Expected tunnel to be closed after shutdown deadline")
+	}
+
+	conn, err = net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer conn.Close()
+	writeConnect(conn)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	fatalOnErr(err, "read CONNECT response", t)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Error("Expected 503 for CONNECT after shutdown, got", resp.Status)
+	}
+}
+
+// hangingHandler doesn't answer requests. It reports when a request starts, and whether
+// it was cancelled.
+type hangingHandler struct {
+	started, cancelled chan bool
+}
+
+func newHangingHandler() hangingHandler {
+	return hangingHandler{make(chan bool, 1), make(chan bool, 1)}
+}
+
+func (h hangingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.started <- true
+	select {
+	case <-r.Context().Done():
+		h.cancelled <- true
+	case <-time.After(5 * time.Second):
+		h.cancelled <- false
+	}
+}
+
+func TestContextCancelledOnClientHangup(t *testing.T) {
+	h := newHangingHandler()
+	upstream := httptest.NewServer(h)
+	defer upstream.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	handlerCtx := make(chan context.Context, 1)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		handlerCtx <- ctx.Context()
+		return req, nil
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	req, _ := http.NewRequest("GET", upstream.URL+"/hang", nil)
+	req.WriteProxy(conn)
+	<-h.started
+	conn.Close()
+	if !<-h.cancelled {
+		t.Error("upstream request should be cancelled when the client hangs up")
+	}
+	if (<-handlerCtx).Err() == nil {
+		t.Error("handler context should be cancelled when the client hangs up")
+	}
+}
+
+func TestMitmContextCancelledOnClientHangup(t *testing.T) {
+	h := newHangingHandler()
+	upstream := httptest.NewTLSServer(h)
+	defer upstream.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	u, _ := url.Parse(upstream.URL)
+	connect := &http.Request{Method: "CONNECT", URL: &url.URL{Opaque: u.Host}, Host: u.Host, Header: http.Header{}}
+	connect.Write(conn)
+	readConnectResponse(bufio.NewReader(conn))
+	tlsConn := tls.Client(conn, acceptAllCerts)
+	req, _ := http.NewRequest("GET", upstream.URL+"/hang", nil)
+	req.Write(tlsConn)
+	<-h.started
+	tlsConn.Close()
+	if !<-h.cancelled {
+		t.Error("upstream request should be cancelled when the mitm'd client hangs up")
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	h := newHangingHandler()
+	upstream := httptest.NewServer(h)
+	defer upstream.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Timeouts.ResponseHeader = 50 * time.Millisecond
+		return req, nil
+	})
+	var ctxErr error
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		ctxErr = ctx.Error
+		return resp
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(upstream.URL + "/hang")
+	fatalOnErr(err, "get through proxy", t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Error("Expected 504 on response header timeout, got", resp.Status)
+	}
+	var perr *goproxy.ProxyError
+	var terr *goproxy.TimeoutError
+	if !errors.As(ctxErr, &perr) || perr.Kind != goproxy.ErrorTimeout ||
+		!errors.As(ctxErr, &terr) || terr.Phase != goproxy.TimeoutResponseHeader {
+		t.Errorf("Expected response header timeout in ctx.Error, got %#v", ctxErr)
+	}
+	if !<-h.cancelled {
+		t.Error("upstream request should be cancelled on timeout")
+	}
+}
+
+func TestRefusedUpgradeBodyTimeout(t *testing.T) {
+	release := make(chan bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		io.WriteString(w, "hello")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer upstream.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Timeouts.Body = 50 * time.Millisecond
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer c.Close()
+	defer close(release)
+	req, _ := http.NewRequest("GET", upstream.URL+"/echo", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	req.WriteProxy(c)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+	}
+	if nerr, ok := err.(net.Error); err == nil || ok && nerr.Timeout() {
+		t.Error("Expected the body of the refused upgrade to be cut on timeout, got", err)
+	}
+}
+
+func TestIdleTunnelTimeout(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return &goproxy.ConnectAction{Action: goproxy.ConnectAccept,
+			Timeouts: &goproxy.Timeouts{IdleTunnel: 50 * time.Millisecond}}, host
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer conn.Close()
+	buf := bufio.NewReader(conn)
+	writeConnect(conn)
+	readConnectResponse(buf)
+
+	// traffic keeps the tunnel open
+	for i := 0; i < 3; i++ {
+		time.Sleep(30 * time.Millisecond)
+		req, _ := http.NewRequest("GET", srv.URL+"/bobo", nil)
+		req.Write(conn)
+		if txt := readResponse(buf); txt != "bobo" {
+			t.Fatal("Expected bobo through tunnel, got", txt)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := buf.ReadByte(); err != io.EOF {
+		t.Error("Expected idle tunnel to be closed, got", err)
+	}
+}
+
+func TestMitmResponseFraming(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/len", "/modified":
+			w.Header().Set("Content-Length", "5")
+			io.WriteString(w, "hello")
+		case "/trailer":
+			w.Header().Set("Trailer", "X-Sum")
+			io.WriteString(w, "hello")
+			w.Header().Set("X-Sum", "42")
+		case "/nocontent":
+			w.WriteHeader(http.StatusNoContent)
+		case "/close":
+			w.Header().Set("Connection", "close")
+			io.WriteString(w, "bye")
+		}
+	}))
+	defer upstream.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnResponse(goproxy.UrlHasPrefix("/modified")).DoFunc(
+		func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+			resp.Body = ioutil.NopCloser(strings.NewReader("HELLO"))
+			return resp
+		})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, test := range []struct {
+		method, path, body string
+		contentLength      int64
+		chunked, close     bool
+		trailer            string
+	}{
+		{"GET", "/len", "hello", 5, false, false, ""},
+		{"HEAD", "/len", "", 5, false, false, ""},
+		{"GET", "/modified", "HELLO", -1, true, false, ""},
+		{"GET", "/trailer", "hello", -1, true, false, "42"},
+		{"GET", "/nocontent", "", 0, false, false, ""},
+		{"GET", "/close", "bye", 3, false, true, ""},
+	} {
+		req, _ := http.NewRequest(test.method, upstream.URL+test.path, nil)
+		resp, err := client.Do(req)
+		fatalOnErr(err, test.method+" "+test.path, t)
+		body := string(readAll(resp.Body, t))
+		resp.Body.Close()
+		chunked := len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"
+		if body != test.body || resp.ContentLength != test.contentLength || chunked != test.chunked ||
+			resp.Close != test.close || resp.Trailer.Get("X-Sum") != test.trailer {
+			t.Errorf("%s %s: got body %q length %d chunked %v close %v trailer %v", test.method, test.path,
+				body, resp.ContentLength, chunked, resp.Close, resp.Trailer)
+		}
+	}
+}
+
+func TestHandlerHandles(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	appendHeader := func(v string) func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			req.Header.Add("X-Order", v)
+			return req, nil
+		}
+	}
+	a := proxy.OnRequest().DoFunc(appendHeader("a")).Named("a")
+	b := proxy.OnRequest().DoFunc(appendHeader("b")).Named("b").WithPriority(10)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK,
+			strings.Join(req.Header["X-Order"], ","))
+	}).Named("echo").WithPriority(-1)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	var names []string
+	for _, h := range proxy.Handlers(goproxy.RequestHandlers) {
+		names = append(names, h.Name())
+	}
+	if strings.Join(names, ",") != "b,a,echo" {
+		t.Error("Expected handlers to be listed in priority order, got", names)
+	}
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "b,a" {
+		t.Error("Expected handlers to run in priority order, got", r)
+	}
+	b.Disable()
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "a" || b.Enabled() {
+		t.Error("Expected disabled handler not to run, got", r)
+	}
+	b.Enable()
+	if !a.Remove() || a.Remove() {
+		t.Error("Expected Remove to report whether the handler was registered")
+	}
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "b" {
+		t.Error("Expected removed handler not to run, got", r)
+	}
+	if len(proxy.Handlers(goproxy.RequestHandlers)) != 2 {
+		t.Error("Expected removed handler not to be listed")
+	}
+}
+
+func TestUpdateHandlersWhileServing(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	constant := func(s string) func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, s)
+		}
+	}
+	h := proxy.OnRequest().DoFunc(constant("old"))
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			proxy.UpdateHandlers(func() {
+				h.Remove()
+				h = proxy.OnRequest().DoFunc(constant("new"))
+			})
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "old" && r != "new" {
+			t.Fatal("Expected a response from one of the handlers, got", r)
+		}
+	}
+	<-done
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "new" {
+		t.Error("Expected the replacement handler, got", r)
+	}
+}
+
+func TestRoundTripHandlers(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.ReqHostIs(srv.Listener.Addr().String())).HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return goproxy.HTTPMitmConnect, host
+	})
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	var order []string
+	var mu sync.Mutex
+	wrap := func(name string) func(req *http.Request, ctx *goproxy.ProxyCtx, next goproxy.RoundTripper) (*http.Response, error) {
+		return func(req *http.Request, ctx *goproxy.ProxyCtx, next goproxy.RoundTripper) (*http.Response, error) {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			resp, err := next.RoundTrip(req, ctx)
+			if err == nil {
+				resp.Header.Add("X-Wrapped", name)
+			}
+			return resp, err
+		}
+	}
+	proxy.OnRequest(goproxy.UrlHasPrefix("/bobo")).DoRoundTripFunc(wrap("outer"))
+	proxy.OnRequest(goproxy.UrlHasPrefix("/bobo")).DoRoundTripFunc(wrap("inner"))
+	proxy.OnRequest(goproxy.UrlHasPrefix("/cached")).DoRoundTripFunc(func(req *http.Request, ctx *goproxy.ProxyCtx, next goproxy.RoundTripper) (*http.Response, error) {
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, "cached"), nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, u := range []string{srv.URL, https.URL} {
+		order = nil
+		resp, err := client.Get(u + "/bobo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := string(readAll(resp.Body, t)); b != "bobo" {
+			t.Error("Expected bobo, got", b)
+		}
+		if w := strings.Join(resp.Header["X-Wrapped"], ","); w != "inner,outer" {
+			t.Error("Expected the response to go through inner then outer, got", w)
+		}
+		if o := strings.Join(order, ","); o != "outer,inner" {
+			t.Error("Expected the request to go through outer then inner, got", o)
+		}
+		order = nil
+		if r := string(getOrFail(u+"/cached", client, t)); r != "cached" {
+			t.Error("Expected a round trip handler to answer without sending the request, got", r)
+		}
+		if len(order) != 0 {
+			t.Error("Expected handlers not to run when conditions don't match, got", order)
+		}
+	}
+
+	c, err := net.Dial("tcp", l.Listener.Addr().String())
+	panicOnErr(err, "dial proxy")
+	defer c.Close()
+	host := srv.Listener.Addr().String()
+	io.WriteString(c, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	r := bufio.NewReader(c)
+	readConnectResponse(r)
+	for _, path := range []string{"/bobo", "/cached", "/bobo"} {
+		order = nil
+		io.WriteString(c, "GET "+path+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		resp, err := http.ReadResponse(r, nil)
+		panicOnErr(err, "read response")
+		b := string(readAll(resp.Body, t))
+		if path == "/cached" {
+			if b != "cached" || len(order) != 0 {
+				t.Error("Expected a round trip handler to answer in HTTP mitm sessions, got", b, order)
+			}
+			continue
+		}
+		if w := strings.Join(resp.Header["X-Wrapped"], ","); b != "bobo" || w != "inner,outer" {
+			t.Error("Expected HTTP mitm'd requests to go through the round trip handlers, got", b, w)
+		}
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "listen")
+	closedAddr := l.Addr().String()
+	l.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.ReqHostIs(https.Listener.Addr().String())).HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest(goproxy.UrlHasPrefix("/unreachable")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		req.URL.Host = closedAddr
+		return req, nil
+	})
+	var mu sync.Mutex
+	var kinds []goproxy.ErrorKind
+	proxy.ErrorHandler = func(req *http.Request, ctx *goproxy.ProxyCtx, err *goproxy.ProxyError) *http.Response {
+		mu.Lock()
+		kinds = append(kinds, err.Kind)
+		mu.Unlock()
+		if ctx.Error != err {
+			t.Error("Expected the error in ctx.Error, got", ctx.Error)
+		}
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, err.StatusCode(), "branded "+err.Kind.String())
+	}
+	client, s := oneShotProxy(proxy, t)
+	defer s.Close()
+
+	for _, u := range []string{
+		"http://" + closedAddr + "/bobo",
+		srv.URL + "/unreachable",
+		https.URL + "/unreachable",
+		"http://nosuchhost.invalid/bobo",
+	} {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Error("Expected an error response for", u, "got", err)
+			continue
+		}
+		b := string(readAll(resp.Body, t))
+		if resp.StatusCode != http.StatusBadGateway || !strings.HasPrefix(b, "branded ") {
+			t.Errorf("Expected a branded 502 for %v, got %v %q", u, resp.Status, b)
+		}
+	}
+	mu.Lock()
+	expected := []goproxy.ErrorKind{goproxy.ErrorDial, goproxy.ErrorDial, goproxy.ErrorDial, goproxy.ErrorDNS}
+	if fmt.Sprint(kinds) != fmt.Sprint(expected) {
+		t.Error("Expected", expected, "got", kinds)
+	}
+	mu.Unlock()
+
+	// the CONNECT itself fails
+	resp, err := client.Get("https://" + closedAddr + "/bobo")
+	if err == nil {
+		resp.Body.Close()
+		t.Error("Expected the CONNECT to a closed port to fail")
+	}
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	panicOnErr(err, "dial proxy")
+	defer c.Close()
+	io.WriteString(c, "CONNECT "+closedAddr+" HTTP/1.1\r\nHost: "+closedAddr+"\r\n\r\n")
+	resp, err = http.ReadResponse(bufio.NewReader(c), nil)
+	panicOnErr(err, "read CONNECT response")
+	if b := string(readAll(resp.Body, t)); resp.StatusCode != http.StatusBadGateway || b != "branded dial error" {
+		t.Errorf("Expected a branded 502 for the CONNECT, got %v %q", resp.Status, b)
+	}
+}
+
+func TestHandlerPanicsAreRecovered(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.ReqHostIs(https.Listener.Addr().String())).HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest(goproxy.ReqHostIs("panic.example.com:443")).HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		panic("connect handler")
+	})
+	proxy.OnRequest(goproxy.ReqHostIs("hijack.example.com:443")).HijackConnect(func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+		panic("hijack")
+	})
+	proxy.OnRequest(goproxy.UrlHasPrefix("/panicreq")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		panic("request handler")
+	})
+	proxy.OnResponse(goproxy.UrlHasPrefix("/panicresp")).DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		panic("response handler")
+	})
+	proxy.OnRequest(goproxy.UrlHasPrefix("/panicroundtrip")).DoRoundTripFunc(func(req *http.Request, ctx *goproxy.ProxyCtx, next goproxy.RoundTripper) (*http.Response, error) {
+		panic("round trip handler")
+	})
+	proxy.OnResponse(goproxy.UrlHasPrefix("/panicstream")).Do(goproxy.HandleStream(func(r io.Reader, w io.Writer, ctx *goproxy.ProxyCtx) error {
+		panic("stream handler")
+	}))
+	var mu sync.Mutex
+	var panics []string
+	proxy.PanicHandler = func(ctx *goproxy.ProxyCtx, v interface{}, stack []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		if ctx.Session == 0 || len(stack) == 0 {
+			t.Error("Expected the session and the stack of the panic")
+		}
+		panics = append(panics, fmt.Sprint(v))
+	}
+	client, s := oneShotProxy(proxy, t)
+	defer s.Close()
+
+	for _, u := range []string{srv.URL, https.URL} {
+		for _, path := range []string{"/panicreq", "/panicresp", "/panicroundtrip"} {
+			resp, err := client.Get(u + path)
+			if err != nil {
+				t.Error("Expected an error response for", u+path, "got", err)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusInternalServerError {
+				t.Error("Expected 500 for", u+path, "got", resp.Status)
+			}
+		}
+		if _, err := get(u+"/panicstream/bobo", client); err == nil {
+			t.Error("Expected the response to be aborted when the body handler panics for", u)
+		}
+		if r := string(getOrFail(u+"/bobo", client, t)); r != "bobo" {
+			t.Error("Expected the proxy to keep working after panics, got", r)
+		}
+	}
+
+	for _, host := range []string{"panic.example.com:443", "hijack.example.com:443"} {
+		c, err := net.Dial("tcp", s.Listener.Addr().String())
+		panicOnErr(err, "dial proxy")
+		io.WriteString(c, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		b, _ := ioutil.ReadAll(c)
+		c.Close()
+		if host == "panic.example.com:443" && !strings.HasPrefix(string(b), "HTTP/1.1 500") {
+			t.Errorf("Expected 500 for the CONNECT, got %q", b)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// the client may retry the request whose response was aborted
+	seen := map[string]int{}
+	for _, p := range panics {
+		seen[p]++
+	}
+	expected := map[string]int{"request handler": 2, "response handler": 2, "round trip handler": 2,
+		"stream handler": 2, "connect handler": 1, "hijack": 1}
+	for p, n := range expected {
+		if seen[p] < n {
+			t.Errorf("Expected %d panics of the %v, got %d", n, p, seen[p])
+		}
+	}
+	if len(seen) != len(expected) {
+		t.Error("Unexpected panics", panics)
+	}
+}
+
+// echoHeaders responds with the request headers as the body, and with hop-by-hop headers
+func echoHeaders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Connection", "X-Hop")
+	w.Header().Set("X-Hop", "1")
+	w.Header().Set("Keep-Alive", "timeout=5")
+	r.Header.Write(w)
+}
+
+func TestHopByHopHeaders(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(echoHeaders))
+	defer s.Close()
+	ts := httptest.NewTLSServer(http.HandlerFunc(echoHeaders))
+	defer ts.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, u := range []string{s.URL, ts.URL} {
+		req, err := http.NewRequest("GET", u, nil)
+		panicOnErr(err, "NewRequest")
+		req.Header.Set("Connection", "X-Custom")
+		req.Header.Set("X-Custom", "1")
+		req.Header.Set("Keep-Alive", "timeout=5")
+		req.Header.Set("Te", "trailers, deflate")
+		req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+		resp, err := client.Do(req)
+		fatalOnErr(err, "client.Do", t)
+		b := string(readAll(resp.Body, t))
+		for _, h := range []string{"X-Custom", "Keep-Alive", "Proxy-Authorization"} {
+			if strings.Contains(b, h+":") {
+				t.Errorf("Expected %v not to be forwarded to %v, got %v", h, u, b)
+			}
+		}
+		if !strings.Contains(b, "Te: trailers\r\n") {
+			t.Error("Expected TE: trailers to be forwarded, got", b)
+		}
+		if resp.Header.Get("X-Hop") != "" || resp.Header.Get("Keep-Alive") != "" {
+			t.Error("Expected hop-by-hop response headers not to be forwarded, got", resp.Header)
+		}
+	}
+}
+
+func TestViaAndForwarded(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(echoHeaders))
+	defer s.Close()
+	ts := httptest.NewTLSServer(http.HandlerFunc(echoHeaders))
+	defer ts.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.AddVia = true
+	proxy.AddForwarded = true
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, u := range []string{s.URL, ts.URL} {
+		scheme, host := u[:strings.Index(u, ":")], u[strings.Index(u, "//")+2:]
+		req, err := http.NewRequest("GET", u, nil)
+		panicOnErr(err, "NewRequest")
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		resp, err := client.Do(req)
+		fatalOnErr(err, "client.Do", t)
+		b := string(readAll(resp.Body, t))
+		if !strings.Contains(b, "Via: 1.1 goproxy (") {
+			t.Errorf("Expected Via to be sent to %v, got %v", u, b)
+		}
+		for _, h := range []string{
+			`Forwarded: for=127.0.0.1;host="` + host + `";proto=` + scheme,
+			"X-Forwarded-For: 10.0.0.1, 127.0.0.1",
+			"X-Forwarded-Host: " + host,
+			"X-Forwarded-Proto: " + scheme,
+		} {
+			if !strings.Contains(b, h+"\r\n") {
+				t.Errorf("Expected %v to be sent to %v, got %v", h, u, b)
+			}
+		}
+		if via := resp.Header.Get("Via"); !strings.HasPrefix(via, "1.1 goproxy (") {
+			t.Error("Expected Via in the response, got", via)
+		}
+	}
+}
+
+func TestMaxForwards(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(echoHeaders))
+	defer s.Close()
+	client, l := oneShotProxy(goproxy.NewProxyHttpServer(), t)
+	defer l.Close()
+
+	for _, method := range []string{"OPTIONS", "TRACE"} {
+		req, err := http.NewRequest(method, s.URL+"/bobo", nil)
+		panicOnErr(err, "NewRequest")
+		req.Header.Set("Max-Forwards", "3")
+		resp, err := client.Do(req)
+		fatalOnErr(err, "client.Do", t)
+		if b := string(readAll(resp.Body, t)); !strings.Contains(b, "Max-Forwards: 2\r\n") {
+			t.Errorf("Expected Max-Forwards to be decremented for %v, got %q", method, b)
+		}
+		req.Header.Set("Max-Forwards", "0")
+		resp, err = client.Do(req)
+		fatalOnErr(err, "client.Do", t)
+		b := string(readAll(resp.Body, t))
+		if resp.StatusCode != http.StatusOK || strings.Contains(b, "Max-Forwards") != (method == "TRACE") {
+			t.Errorf("Expected the proxy to answer %v itself, got %v %q", method, resp.Status, b)
+		}
+	}
+}
+
+func TestMitmExpectContinue(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer s.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return goproxy.HTTPMitmConnect, host
+	})
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if r.URL.Path == "/refused" {
+			return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusForbidden, "refused")
+		}
+		return r, nil
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Listener.Addr().String())
+	panicOnErr(err, "dial proxy")
+	defer c.Close()
+	host := s.Listener.Addr().String()
+	io.WriteString(c, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	r := bufio.NewReader(c)
+	readConnectResponse(r)
+	io.WriteString(c, "POST /echo HTTP/1.1\r\nHost: "+host+"\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n")
+	line, err := r.ReadString('\n')
+	panicOnErr(err, "read 100 Continue")
+	if line != "HTTP/1.1 100 Continue\r\n" {
+		t.Fatalf("Expected 100 Continue, got %q", line)
+	}
+	r.ReadString('\n')
+	io.WriteString(c, "bobo")
+	resp, err := http.ReadResponse(r, nil)
+	panicOnErr(err, "read response")
+	if b := string(readAll(resp.Body, t)); b != "bobo" {
+		t.Error("Expected the body to be sent after 100 Continue, got", b)
+	}
+
+	// the body is not waited for if a handler answers the request
+	io.WriteString(c, "POST /refused HTTP/1.1\r\nHost: "+host+"\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err = http.ReadResponse(r, nil)
+	fatalOnErr(err, "read refused response", t)
+	if resp.StatusCode != http.StatusForbidden || !resp.Close {
+		t.Error("Expected the refused response, closing the connection, got", resp.Status, resp.Close)
+	}
+}
+
+// gzipBobo responds with bobo, gzipped if the client accepts it, and tells which encodings
+// the client accepts in X-Accept-Encoding
+func gzipBobo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Accept-Encoding", r.Header.Get("Accept-Encoding"))
+	if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		io.WriteString(w, "bobo")
+		return
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	io.WriteString(gz, "bobo")
+	gz.Close()
+}
+
+func TestContentEncodingNegotiation(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(gzipBobo))
+	defer s.Close()
+	ts := httptest.NewTLSServer(http.HandlerFunc(gzipBobo))
+	defer ts.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnResponse(goproxy.UrlHasPrefix("/modify")).Do(goproxy.HandleBytes(func(b []byte, ctx *goproxy.ProxyCtx) []byte {
+		return bytes.Replace(b, []byte("bobo"), []byte("koko"), -1)
+	}))
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	proxyUrl, _ := url.Parse(l.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl),
+		TLSClientConfig: acceptAllCerts, DisableCompression: true}}
+
+	for _, u := range []string{s.URL, ts.URL} {
+		for _, c := range []struct {
+			path, accept, encoding, body string
+		}{
+			// not touched by the handlers, sent as received
+			{"/bobo", "gzip", "gzip", "bobo"},
+			// decoded, since the client doesn't accept gzip
+			{"/bobo", "", "", "bobo"},
+			// decoded for the handler, and encoded again
+			{"/modify", "gzip", "gzip", "koko"},
+			{"/modify", "br;q=1, deflate;q=0.5", "deflate", "koko"},
+			{"/modify", "identity", "", "koko"},
+		} {
+			req, err := http.NewRequest("GET", u+c.path, nil)
+			panicOnErr(err, "NewRequest")
+			if c.accept != "" {
+				req.Header.Set("Accept-Encoding", c.accept)
+			}
+			resp, err := client.Do(req)
+			fatalOnErr(err, "client.Do", t)
+			if a := resp.Header.Get("X-Accept-Encoding"); a != "gzip, deflate" {
+				t.Error("Expected the proxy to negotiate the encoding with the server, got", a)
+			}
+			var body io.Reader = resp.Body
+			switch resp.Header.Get("Content-Encoding") {
+			case "gzip":
+				body, err = gzip.NewReader(resp.Body)
+			case "deflate":
+				body, err = zlib.NewReader(resp.Body)
+			}
+			fatalOnErr(err, "decoding response", t)
+			b := string(readAll(body, t))
+			resp.Body.Close()
+			if resp.Header.Get("Content-Encoding") != c.encoding || b != c.body {
+				t.Errorf("Expected %q encoded with %q for %v accepting %q, got %q encoded with %q",
+					c.body, c.encoding, u+c.path, c.accept, b, resp.Header.Get("Content-Encoding"))
+			}
+			if c.path == "/bobo" && c.encoding == "gzip" && resp.ContentLength < 0 {
+				t.Error("Expected Content-Length to be kept for a response sent as received")
+			}
+		}
+	}
+
+	// without handlers to read the bodies, the client negotiates with the server itself
+	client, l2 := oneShotProxy(goproxy.NewProxyHttpServer(), t)
+	defer l2.Close()
+	req, err := http.NewRequest("GET", s.URL+"/bobo", nil)
+	panicOnErr(err, "NewRequest")
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := client.Do(req)
+	fatalOnErr(err, "client.Do", t)
+	if a, b := resp.Header.Get("X-Accept-Encoding"), string(readAll(resp.Body, t)); a != "identity" || b != "bobo" {
+		t.Errorf("Expected the Accept-Encoding of the client to be sent as is, got %q and %q", a, b)
+	}
+
+	// nor with handlers which are not marked as reading them
+	proxy = goproxy.NewProxyHttpServer()
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		resp.Header.Set("X-Proxied", "1")
+		return resp
+	})
+	proxy.OnRequest().DoRoundTripFunc(func(req *http.Request, ctx *goproxy.ProxyCtx, next goproxy.RoundTripper) (*http.Response, error) {
+		return next.RoundTrip(req, ctx)
+	})
+	marked := proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		return resp
+	})
+	marked.Disable()
+	client, l3 := oneShotProxy(proxy, t)
+	defer l3.Close()
+	for _, c := range []struct {
+		readsBodies bool
+		accept      string
+	}{{false, "identity"}, {true, "gzip, deflate"}} {
+		if c.readsBodies {
+			marked.ReadsBodies().Enable()
+		}
+		resp, err := client.Do(req)
+		fatalOnErr(err, "client.Do", t)
+		if a, b := resp.Header.Get("X-Accept-Encoding"), string(readAll(resp.Body, t)); a != c.accept || b != "bobo" {
+			t.Errorf("Expected the server to be asked for %q, got %q and %q", c.accept, a, b)
+		}
+	}
+}
+
+func TestShapeNetwork(t *testing.T) {
+	body := strings.Repeat("x", 100*1024)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	})
+	s := httptest.NewServer(handler)
+	defer s.Close()
+	ts := httptest.NewTLSServer(handler)
+	defer ts.Close()
+	profile := goproxy.NetworkProfile{Latency: 100 * time.Millisecond, Down: 400 * 1024}
+
+	for _, connect := range []*goproxy.ConnectAction{goproxy.OkConnect, goproxy.MitmConnect} {
+		proxy := goproxy.NewProxyHttpServer()
+		proxy.OnRequest().ShapeNetwork(profile)
+		proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			return connect, host
+		})
+		client, l := oneShotProxy(proxy, t)
+		for _, u := range []string{s.URL, ts.URL} {
+			start := time.Now()
+			if b := string(getOrFail(u, client, t)); b != body {
+				t.Errorf("Wrong body of %v through a shaped connection, got %d bytes", u, len(b))
+			}
+			// the body takes 250ms at 400KB/s, the handshakes take a few round trips
+			if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+				t.Errorf("Expected %v to be slowed down by the network profile, took %v", u, elapsed)
+			}
+		}
+		l.Close()
+	}
+}
+
+func TestShapeUpstream(t *testing.T) {
+	var mu sync.Mutex
+	accepted := map[string]time.Time{}
+	// the servers tell how long after the connection was accepted they got the request
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		io.WriteString(w, time.Since(accepted[r.RemoteAddr]).String())
+	})
+	connState := func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			accepted[c.RemoteAddr().String()] = time.Now()
+			mu.Unlock()
+		}
+	}
+	s := httptest.NewUnstartedServer(handler)
+	s.Config.ConnState = connState
+	s.Start()
+	defer s.Close()
+	ts := httptest.NewUnstartedServer(handler)
+	ts.Config.ConnState = connState
+	ts.StartTLS()
+	defer ts.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	// each direction of the upstream connections is delayed by 100ms
+	proxy.OnRequest().ShapeNetwork(goproxy.NetworkProfile{Latency: 400 * time.Millisecond})
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, c := range []struct {
+		url string
+		min time.Duration
+	}{
+		{s.URL, 80 * time.Millisecond},
+		// the TLS handshake takes a round trip more
+		{ts.URL, 250 * time.Millisecond},
+	} {
+		d, err := time.ParseDuration(string(getOrFail(c.url, client, t)))
+		fatalOnErr(err, "ParseDuration", t)
+		if d < c.min {
+			t.Errorf("Expected the connection to %v to be shaped, the request came after %v", c.url, d)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	var mu sync.Mutex
+	tries := map[string]int{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		tries[r.URL.Path]++
+		n := tries[r.URL.Path]
+		mu.Unlock()
+		if r.URL.Path == "/later" {
+			w.Header().Set("Retry-After", "60")
+		}
+		if n < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(b)
+	}))
+	defer s.Close()
+	closed := httptest.NewServer(nil)
+	closed.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Retry = &goproxy.RetryPolicy{MaxAttempts: 3, Statuses: []int{503},
+		BaseDelay: 10 * time.Millisecond, MaxDelay: time.Second, BufferBody: 1024}
+	var attempts []goproxy.Attempt
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		mu.Lock()
+		attempts = ctx.Attempts
+		mu.Unlock()
+		return resp
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	send := func(method, path, body string) (int, string, []goproxy.Attempt) {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		panicOnErr(err, "NewRequest")
+		if path == "/streamed" {
+			req.Body = io.NopCloser(strings.NewReader(body))
+			req.GetBody, req.ContentLength = nil, -1
+		}
+		resp, err := client.Do(req)
+		fatalOnErr(err, "client.Do", t)
+		b := string(readAll(resp.Body, t))
+		mu.Lock()
+		defer mu.Unlock()
+		return resp.StatusCode, b, attempts
+	}
+	if status, _, attempts := send("GET", "/get", ""); status != 200 || len(attempts) != 3 ||
+		attempts[0].Response.StatusCode != 503 || attempts[2].Response.StatusCode != 200 {
+		t.Error("Expected GET to succeed on the third attempt, got", status, attempts)
+	}
+	if status, b, _ := send("POST", "/post", "bobo"); status != 200 || b != "bobo" {
+		t.Error("Expected the buffered body of POST to be sent again, got", status, b)
+	}
+	proxy.Retry.BufferBody = 0
+	if status, _, attempts := send("POST", "/streamed", "bobo"); status != 503 || len(attempts) != 1 {
+		t.Error("POST with a body which is not buffered should not be retried, got", status, len(attempts))
+	}
+	if status, _, attempts := send("GET", "/later", ""); status != 503 || len(attempts) != 1 {
+		t.Error("Responses with a Retry-After longer than MaxDelay should not be retried, got", status, len(attempts))
+	}
+	resp, err := client.Get(closed.URL)
+	fatalOnErr(err, "client.Get", t)
+	resp.Body.Close()
+	mu.Lock()
+	if resp.StatusCode != http.StatusBadGateway || len(attempts) != 3 || attempts[2].Error == nil {
+		t.Error("Expected dial failures to be retried, got", resp.Status, attempts)
+	}
+	mu.Unlock()
+}
+
+func TestUpstreamPools(t *testing.T) {
+	var unhealthy int32
+	backend := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" && name == "b" && atomic.LoadInt32(&unhealthy) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(status)
+			io.WriteString(w, name)
+		}))
+	}
+	a, b, bad := backend("a", 200), backend("b", 200), backend("bad", 500)
+	defer a.Close()
+	defer b.Close()
+	defer bad.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	var endpoints []*goproxy.Endpoint
+	var mu sync.Mutex
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Upstream = r.Header.Get("X-Pool")
+		return r, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		mu.Lock()
+		defer mu.Unlock()
+		endpoints = endpoints[:0]
+		for _, a := range ctx.Attempts {
+			endpoints = append(endpoints, a.Endpoint)
+		}
+		return resp
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	newPool := func(name string, balancer goproxy.Balancer, servers ...*httptest.Server) []*goproxy.Endpoint {
+		pool := goproxy.NewPool(name, balancer)
+		var added []*goproxy.Endpoint
+		for i, s := range servers {
+			e, err := pool.Add(s.URL, i+1)
+			panicOnErr(err, "pool.Add")
+			added = append(added, e)
+		}
+		if name == "checked" {
+			pool.HealthCheck = &goproxy.HealthCheck{Path: "/health", Interval: 10 * time.Millisecond}
+		}
+		pool.Outliers = &goproxy.OutlierDetection{ConsecutiveFailures: 2, EjectionTime: time.Minute}
+		proxy.Pools.Add(pool)
+		return added
+	}
+	get := func(pool, key string) (int, string) {
+		req, err := http.NewRequest("GET", "http://upstream.invalid/", nil)
+		panicOnErr(err, "NewRequest")
+		req.Header.Set("X-Pool", pool)
+		req.Header.Set("X-User", key)
+		resp, err := client.Do(req)
+		fatalOnErr(err, "client.Do", t)
+		return resp.StatusCode, string(readAll(resp.Body, t))
+	}
+	sequence := func(pool string, n int) string {
+		var s []string
+		for i := 0; i < n; i++ {
+			_, b := get(pool, "")
+			s = append(s, b)
+		}
+		return strings.Join(s, ",")
+	}
+
+	rr := newPool("rr", goproxy.RoundRobin(), a, b)
+	if s := sequence("rr", 4); s != "a,b,a,b" {
+		t.Error("Expected requests to be sent in turn, got", s)
+	}
+	mu.Lock()
+	if len(endpoints) != 1 || endpoints[0] != rr[1] {
+		t.Error("Expected the attempt to record its endpoint, got", endpoints)
+	}
+	mu.Unlock()
+	newPool("weighted", goproxy.Weighted(), a, b)
+	if s := sequence("weighted", 6); s != "b,a,b,b,a,b" {
+		t.Error("Expected b to get twice as many requests as a, got", s)
+	}
+	newPool("leastconn", goproxy.LeastConn(), a, b)
+	if s := sequence("leastconn", 4); !strings.Contains(s, "a") || !strings.Contains(s, "b") {
+		t.Error("Expected idle endpoints to be used in turn, got", s)
+	}
+
+	newPool("sticky", goproxy.ConsistentHash(goproxy.HashHeader("X-User")), a, b)
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprint("user", i)
+		_, first := get("sticky", key)
+		seen[first] = true
+		for j := 0; j < 3; j++ {
+			if _, next := get("sticky", key); next != first {
+				t.Error("Expected", key, "to stick to", first, "got", next)
+			}
+		}
+	}
+	if len(seen) != 2 {
+		t.Error("Expected the keys to be spread across the endpoints, got", seen)
+	}
+
+	outliers := newPool("outliers", nil, a, bad)
+	if s := sequence("outliers", 6); s != "a,bad,a,bad,a,a" {
+		t.Error("Expected the failing endpoint to be ejected, got", s)
+	}
+	if outliers[1].Healthy() || !outliers[0].Healthy() {
+		t.Error("Expected only the failing endpoint to be unhealthy")
+	}
+
+	checked := newPool("checked", nil, a, b)
+	atomic.StoreInt32(&unhealthy, 1)
+	for deadline := time.Now().Add(time.Second); checked[1].Healthy() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := sequence("checked", 3); s != "a,a,a" {
+		t.Error("Expected the endpoint failing its health checks to be skipped, got", s)
+	}
+	atomic.StoreInt32(&unhealthy, 0)
+	for deadline := time.Now().Add(time.Second); !checked[1].Healthy() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !checked[1].Healthy() {
+		t.Error("Expected the endpoint to be healthy again")
+	}
+	if !proxy.Pools.Remove("checked") || proxy.Pools.Get("checked") != nil {
+		t.Error("Expected the pool to be removed")
+	}
+
+	newPool("down", nil, bad)
+	get("down", "")
+	get("down", "")
+	if status, _ := get("down", ""); status != http.StatusServiceUnavailable {
+		t.Error("Expected a pool without healthy endpoints to fail with 503, got", status)
+	}
+	if status, _ := get("unknown", ""); status != http.StatusInternalServerError {
+		t.Error("Expected an unknown pool to fail with 500, got", status)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing, slow, hits int32 = 1, 0, 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&slow) == 1 {
+			time.Sleep(30 * time.Millisecond)
+		}
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer s.Close()
+	key := s.Listener.Addr().String()
+
+	proxy := goproxy.NewProxyHttpServer()
+	var mu sync.Mutex
+	var changes []string
+	proxy.Breakers = &goproxy.Breakers{MinRequests: 2, ErrorRate: 0.5, SlowDuration: 20 * time.Millisecond,
+		SlowRate: 1, OpenTimeout: 100 * time.Millisecond,
+		OnStateChange: func(key string, from, to goproxy.BreakerState) {
+			mu.Lock()
+			defer mu.Unlock()
+			changes = append(changes, from.String()+">"+to.String())
+		}}
+	var kind goproxy.ErrorKind
+	proxy.ErrorHandler = func(req *http.Request, ctx *goproxy.ProxyCtx, err *goproxy.ProxyError) *http.Response {
+		kind = err.Kind
+		return nil
+	}
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	status := func() int {
+		resp, err := client.Get(s.URL)
+		fatalOnErr(err, "client.Get", t)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	status()
+	status()
+	if state := proxy.Breakers.State(key); state != goproxy.BreakerOpen {
+		t.Fatal("Expected the breaker to open after failures, got", state)
+	}
+	if code := status(); code != http.StatusServiceUnavailable || kind != goproxy.ErrorCircuitOpen ||
+		atomic.LoadInt32(&hits) != 2 {
+		t.Error("Expected the request to fail fast, got", code, kind, hits)
+	}
+	time.Sleep(150 * time.Millisecond)
+	atomic.StoreInt32(&failing, 0)
+	if code := status(); code != 200 || proxy.Breakers.State(key) != goproxy.BreakerClosed {
+		t.Error("Expected the trial request to close the breaker, got", code, proxy.Breakers.State(key))
+	}
+
+	atomic.StoreInt32(&slow, 1)
+	status()
+	status()
+	stats := proxy.Breakers.Stats()
+	if len(stats) != 1 || stats[0].State != goproxy.BreakerOpen || stats[0].Rejected != 1 || stats[0].Trips != 2 {
+		t.Error("Expected the breaker to open on slow requests, got", stats)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if c := strings.Join(changes, ","); c != "closed>open,open>half-open,half-open>closed,closed>open" {
+		t.Error("Unexpected state changes", c)
+	}
+}
+
+func TestIdleBreakersDropped(t *testing.T) {
+	idle := httptest.NewServer(ConstantHanlder("idle"))
+	defer idle.Close()
+	busy := httptest.NewServer(ConstantHanlder("busy"))
+	defer busy.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Breakers = &goproxy.Breakers{Window: 50 * time.Millisecond}
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(idle.URL, client, t)
+	time.Sleep(100 * time.Millisecond)
+	getOrFail(busy.URL, client, t)
+	stats := proxy.Breakers.Stats()
+	if len(stats) != 1 || stats[0].Key != busy.Listener.Addr().String() {
+		t.Error("Expected the breaker of the idle upstream to be dropped, got", stats)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	// round is a fetch of n identical requests, its first request being answered once
+	// they all reached the coalescer
+	type round struct {
+		n, arrived int32
+		hits       int32
+		all        chan bool
+	}
+	var mu sync.Mutex
+	var current *round
+	get := func() *round {
+		mu.Lock()
+		defer mu.Unlock()
+		return current
+	}
+	body := strings.Repeat("0123456789", 100*1000)
+	handler := func(get func() *round) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			rd := get()
+			if atomic.AddInt32(&rd.hits, 1) == 1 {
+				<-rd.all
+			}
+			if r.URL.Path == "/cookie" {
+				w.Header().Set("Set-Cookie", "session=1")
+			}
+			io.WriteString(w, body)
+		}
+	}
+	s := httptest.NewServer(handler(get))
+	defer s.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoRoundTripFunc(func(req *http.Request, ctx *goproxy.ProxyCtx, next goproxy.RoundTripper) (*http.Response, error) {
+		rd := get()
+		if atomic.AddInt32(&rd.arrived, 1) == rd.n {
+			close(rd.all)
+		}
+		return next.RoundTrip(req, ctx)
+	})
+	proxy.OnRequest().Coalesce()
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		b, err := io.ReadAll(resp.Body)
+		panicOnErr(err, "ReadAll")
+		resp.Body = io.NopCloser(bytes.NewReader(bytes.ToUpper(b)))
+		return resp
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	fetch := func(path string, n int) int32 {
+		rd := &round{n: int32(n), all: make(chan bool)}
+		mu.Lock()
+		current = rd
+		mu.Unlock()
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := client.Get(s.URL + path)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer resp.Body.Close()
+				if b, err := io.ReadAll(resp.Body); err != nil || string(b) != strings.ToUpper(body) {
+					t.Error("Unexpected body of length", len(b), err)
+				}
+			}()
+		}
+		wg.Wait()
+		return atomic.LoadInt32(&rd.hits)
+	}
+	if hits := fetch("/artifact", 10); hits != 1 {
+		t.Error("Expected the identical requests to be sent once, server got", hits)
+	}
+	if hits := fetch("/cookie", 3); hits != 3 {
+		t.Error("Expected responses setting cookies not to be shared, server got", hits)
+	}
+	if hits := fetch("/artifact", 2); hits != 1 {
+		t.Error("Expected requests to be coalesced again, server got", hits)
+	}
+}
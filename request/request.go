@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/mailgun/vulcan/netutils"
+	"github.com/marbemac/goproxy"
 	"github.com/marbemac/stoplight/models"
 	"github.com/marbemac/stoplight/router"
 
@@ -50,14 +51,14 @@ type Attempt interface {
 	GetError() error
 	GetDuration() time.Duration
 	GetResponse() *http.Response
-	// GetEndpoint() endpoint.Endpoint
+	GetEndpoint() *goproxy.Endpoint
 }
 
 type BaseAttempt struct {
 	Error    error
 	Duration time.Duration
 	Response *http.Response
-	// Endpoint endpoint.Endpoint
+	Endpoint *goproxy.Endpoint
 }
 
 func (ba *BaseAttempt) GetResponse() *http.Response {
@@ -72,9 +73,9 @@ func (ba *BaseAttempt) GetDuration() time.Duration {
 	return ba.Duration
 }
 
-// func (ba *BaseAttempt) GetEndpoint() endpoint.Endpoint {
-//   return ba.Endpoint
-// }
+func (ba *BaseAttempt) GetEndpoint() *goproxy.Endpoint {
+	return ba.Endpoint
+}
 
 type BaseRequest struct {
 	HttpRequest   *http.Request
@@ -0,0 +1,201 @@
+package goproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Attempt is a try at sending a request upstream, see ProxyCtx.Attempts. The body of the
+// Response of a retried attempt is closed.
+type Attempt struct {
+	Error    error
+	Duration time.Duration
+	Response *http.Response
+	// Endpoint is the endpoint of ctx.Upstream the request was sent to, if any
+	Endpoint *Endpoint
+}
+
+// RetryPolicy tells which requests are sent again when they fail. A request is retried if it
+// can be sent again, because it has no body, its body is buffered (http.Request.GetBody is
+// set, or BufferBody is large enough), and if:
+//   - the destination server could not be dialed, in which case nothing was sent
+//   - or the connection was reset, or the response status is one of Statuses, and the
+//     request is idempotent, or its body was buffered
+//
+// Retries are delayed by an exponential backoff with jitter, or by the Retry-After of the
+// response if it is longer. Each try is recorded in ctx.Attempts.
+//	proxy.Retry = &goproxy.RetryPolicy{MaxAttempts: 3, Statuses: []int{502, 503, 504},
+//		BaseDelay: 100 * time.Millisecond, MaxDelay: 5 * time.Second}
+type RetryPolicy struct {
+	// MaxAttempts is the most times a request is sent, the first time included
+	MaxAttempts int
+	// Statuses are the response statuses which are retried
+	Statuses []int
+	// BaseDelay is the backoff before the first retry, doubled on each retry up to MaxDelay.
+	// The delay is picked randomly between half the backoff and the backoff. Responses with
+	// a Retry-After longer than MaxDelay are not retried.
+	BaseDelay, MaxDelay time.Duration
+	// BufferBody, if positive, buffers the request bodies of up to BufferBody bytes, so that
+	// they can be sent again
+	BufferBody int64
+}
+
+// idempotentMethods are the methods of RFC 7231 section 4.2.2
+var idempotentMethods = map[string]bool{"GET": true, "HEAD": true, "OPTIONS": true, "TRACE": true,
+	"PUT": true, "DELETE": true}
+
+// isIdempotent reports whether req can be sent more than once with the same effect, as told
+// by its method, or by an Idempotency-Key header as http.Transport does
+func isIdempotent(req *http.Request) bool {
+	if idempotentMethods[req.Method] {
+		return true
+	}
+	_, key := req.Header["Idempotency-Key"]
+	_, xkey := req.Header["X-Idempotency-Key"]
+	return key || xkey
+}
+
+func hasReqBody(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody
+}
+
+// bufferBody makes the body of req replayable if it is small enough, reporting whether it is
+func (p *RetryPolicy) bufferBody(req *http.Request) bool {
+	if !hasReqBody(req) || req.GetBody != nil {
+		return true
+	}
+	if p.BufferBody <= 0 || req.ContentLength > p.BufferBody {
+		return false
+	}
+	b, err := io.ReadAll(io.LimitReader(req.Body, p.BufferBody+1))
+	if err != nil || int64(len(b)) > p.BufferBody {
+		// the body is sent as is, what was read first
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), &errReader{err}, req.Body), req.Body}
+		return false
+	}
+	req.Body.Close()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return true
+}
+
+// errReader fails with err, or is empty if err is nil
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return 0, io.EOF
+}
+
+// isReset reports whether err is the connection to the destination server being reset or
+// closed before the response
+func isReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isDialError reports whether err is a failure to connect to the destination server
+func isDialError(err error) bool {
+	var timeoutErr *TimeoutError
+	if errors.As(err, &timeoutErr) && timeoutErr.Phase == TimeoutDial {
+		return true
+	}
+	return newProxyError(ErrorUpstream, err).Kind == ErrorDial
+}
+
+func (p *RetryPolicy) retriesStatus(status int) bool {
+	for _, s := range p.Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the retry-th retry
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAfter parses the Retry-After header of resp, in seconds or as an HTTP date
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// roundTrip sends req with send, retrying it following the policy p, which may be nil
+func (p *RetryPolicy) roundTrip(req *http.Request, ctx *ProxyCtx, send RoundTripperFunc) (*http.Response, error) {
+	if p == nil || p.MaxAttempts <= 1 {
+		return send(req, ctx)
+	}
+	replayable := p.bufferBody(req)
+	buffered := hasReqBody(req) && replayable
+	for try := 1; ; try++ {
+		resp, err := send(req, ctx)
+		if try >= p.MaxAttempts || !replayable {
+			return resp, err
+		}
+		var delay time.Duration
+		switch {
+		case err != nil && isDialError(err):
+		case err != nil && isReset(err) && (isIdempotent(req) || buffered):
+		case err == nil && p.retriesStatus(resp.StatusCode) && (isIdempotent(req) || buffered):
+			delay = retryAfter(resp)
+			if p.MaxDelay > 0 && delay > p.MaxDelay {
+				return resp, nil
+			}
+		default:
+			return resp, err
+		}
+		if backoff := p.backoff(try); backoff > delay {
+			delay = backoff
+		}
+		if resp != nil {
+			resp.Body.Close()
+			ctx.Logf("Retrying %v %v in %v after status %v", req.Method, req.URL, delay, resp.Status)
+		} else {
+			ctx.Logf("Retrying %v %v in %v after error %v", req.Method, req.URL, delay, err)
+		}
+		if !sleepUntil(time.Now().Add(delay), req.Context().Done()) {
+			return nil, req.Context().Err()
+		}
+		req = req.Clone(req.Context())
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
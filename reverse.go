@@ -0,0 +1,170 @@
+package goproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// A Route sends non-proxy requests, that is requests with a relative URI such as
+// 'GET /foo' with a Host header, to an upstream server. This allows using the proxy
+// as a reverse proxy in front of internal servers, while still filtering the requests
+// and responses through the usual handlers.
+type Route struct {
+	// Host the request must be directed to, as found in its Host header. If Host
+	// has no port, any port matches. An empty Host matches any request.
+	Host string
+	// PathPrefix the request path must start with, on a path segment boundary: "/api"
+	// matches "/api" and "/api/users", but not "/apifoo"
+	PathPrefix string
+	// Upstream is the server requests are sent to. If it has a path, it is prepended
+	// to the request path.
+	Upstream *url.URL
+	// StripPrefix removes PathPrefix from the request path before sending it upstream
+	StripPrefix bool
+	// PreserveHost keeps the Host header sent by the client, instead of using the host
+	// of Upstream.
+	PreserveHost bool
+}
+
+func (route *Route) matches(r *http.Request) bool {
+	if route.Host != "" {
+		host := strings.ToLower(r.Host)
+		if !hasPort.MatchString(route.Host) {
+			host = stripPort(host)
+		}
+		if host != strings.ToLower(route.Host) {
+			return false
+		}
+	}
+	return hasPathPrefix(r.URL.Path, route.PathPrefix)
+}
+
+// hasPathPrefix reports whether path starts with the path segments of prefix
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || prefix == "" || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// rewrite makes r an absolute request directed to the route upstream
+func (route *Route) rewrite(r *http.Request) {
+	path, rawPath := r.URL.Path, r.URL.RawPath
+	if route.StripPrefix {
+		path = strings.TrimPrefix(path, route.PathPrefix)
+		rawPath = strings.TrimPrefix(rawPath, route.PathPrefix)
+	}
+	r.URL.Scheme = route.Upstream.Scheme
+	r.URL.Host = route.Upstream.Host
+	r.URL.Path, r.URL.RawPath = singleJoiningSlash(route.Upstream.Path, path), ""
+	if rawPath != "" {
+		// RawPath is only used if it is still an encoding of Path, see url.URL.EscapedPath
+		r.URL.RawPath = singleJoiningSlash(route.Upstream.EscapedPath(), rawPath)
+	}
+	if route.Upstream.RawQuery != "" {
+		if r.URL.RawQuery == "" {
+			r.URL.RawQuery = route.Upstream.RawQuery
+		} else {
+			r.URL.RawQuery = route.Upstream.RawQuery + "&" + r.URL.RawQuery
+		}
+	}
+	if !route.PreserveHost {
+		r.Host = route.Upstream.Host
+	}
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// RoutingTable holds the routes of a proxy in reverse proxy mode. Routes can be added and
+// removed while the proxy is serving requests, but a Route itself must not be modified then,
+// since the requests read it without locking: remove it and add a modified copy instead.
+type RoutingTable struct {
+	mu     sync.RWMutex
+	routes []*Route
+}
+
+// NewRoutingTable returns an empty routing table
+func NewRoutingTable() *RoutingTable {
+	return &RoutingTable{}
+}
+
+// Add registers a route sending requests for host, whose path start with prefix, to upstream.
+// Its other fields can be set on the route returned until the proxy serves requests; after
+// that, set them before AddRoute instead.
+//	proxy.Routes.Add("api.example.com", "/users", "http://10.0.0.7:8080")
+//	proxy.Routes.Add("", "/", "http://10.0.0.8") // everything else
+func (t *RoutingTable) Add(host, prefix, upstream string) (*Route, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.New("upstream must be an absolute URL: " + upstream)
+	}
+	route := &Route{Host: host, PathPrefix: prefix, Upstream: u}
+	t.AddRoute(route)
+	return route, nil
+}
+
+// AddRoute registers route in the routing table
+func (t *RoutingTable) AddRoute(route *Route) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.routes = append(t.routes, route)
+}
+
+// Remove removes route from the routing table. Returns false if route was not found.
+func (t *RoutingTable) Remove(route *Route) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, r := range t.routes {
+		if r == route {
+			t.routes = append(t.routes[:i:i], t.routes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Routes returns a copy of all the routes in the table, in the order they were added
+func (t *RoutingTable) Routes() []*Route {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append([]*Route(nil), t.routes...)
+}
+
+// Match returns the route r should be sent to, or nil if no route matches.
+// Routes with a Host are preferred over routes matching any host, and then
+// the route with the longest PathPrefix wins.
+func (t *RoutingTable) Match(r *http.Request) *Route {
+	if t == nil {
+		return nil
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var best *Route
+	for _, route := range t.routes {
+		if !route.matches(r) {
+			continue
+		}
+		if best == nil ||
+			(route.Host != "" && best.Host == "") ||
+			((route.Host != "") == (best.Host != "") && len(route.PathPrefix) > len(best.PathPrefix)) {
+			best = route
+		}
+	}
+	return best
+}
@@ -0,0 +1,488 @@
+package goproxy
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// NetworkProfile emulates the network conditions of a client, such as a mobile network,
+// by delaying and throttling the data sent to and from it. It is set in ctx.Network, see
+// ReqProxyConds.ShapeNetwork.
+//
+// Both the client connection and the connections to the upstream servers are shaped, TLS
+// handshakes included, each of them adding half of the latency. The connections of CONNECT
+// sessions, whether tunneled or man in the middle'd, are shaped as a whole. Requests sent
+// directly to the proxy have their client half shaped one by one, their bodies being
+// throttled, since their client connection is managed by net/http.
+type NetworkProfile struct {
+	// Latency is added to the round trip time, half of it in each direction
+	Latency time.Duration
+	// Jitter varies the latency of each direction randomly, by up to Jitter either way.
+	// The data is never reordered.
+	Jitter time.Duration
+	// Down and Up cap the bandwidth to the client and from the client, in bytes per
+	// second. Zero means no cap.
+	Down, Up int64
+}
+
+// Some usual network profiles
+var (
+	NetworkGPRS = NetworkProfile{Latency: 500 * time.Millisecond, Jitter: 50 * time.Millisecond, Down: 6250, Up: 2500}
+	Network3G   = NetworkProfile{Latency: 100 * time.Millisecond, Jitter: 20 * time.Millisecond, Down: 93750, Up: 31250}
+	Network4G   = NetworkProfile{Latency: 20 * time.Millisecond, Jitter: 5 * time.Millisecond, Down: 500000, Up: 375000}
+)
+
+// delay returns the one way latency of the next chunk of data
+func (p *NetworkProfile) delay() time.Duration {
+	d := p.Latency / 2
+	if p.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(2*p.Jitter))) - p.Jitter
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// leg returns the profile shaping each of the client and the upstream connections, which
+// together add the latency of p
+func (p *NetworkProfile) leg() *NetworkProfile {
+	l := *p
+	l.Latency, l.Jitter = p.Latency/2, p.Jitter/2
+	return &l
+}
+
+// shapeConn returns c shaped by p, c being the client connection, or a connection to an
+// upstream server, whose data goes the other way
+func shapeConn(c net.Conn, p *NetworkProfile, upstream bool) net.Conn {
+	in, out := p.Up, p.Down
+	if upstream {
+		in, out = p.Down, p.Up
+	}
+	s := &shapedConn{
+		Conn:     c,
+		in:       newDelayLine(p, in),
+		out:      newDelayLine(p, out),
+		closing:  make(chan struct{}),
+		flushed:  make(chan struct{}),
+		deadline: make(chan struct{}),
+		maxDelay: p.Latency/2 + p.Jitter,
+	}
+	go s.pump()
+	go s.flush()
+	return s
+}
+
+// chunk is data, or the error ending it, delivered once due
+type chunk struct {
+	b   []byte
+	err error
+	due time.Time
+}
+
+// delayLine delays the data going one way on a shaped connection. Data is sent no faster
+// than the rate, and is received after the latency of the profile. There is a single
+// sender, blocking while its data is transmitted, so that only the data in flight is held.
+type delayLine struct {
+	p    *NetworkProfile
+	rate int64
+	// next is when the previous data is transmitted, lastDue when it is received
+	next, lastDue time.Time
+	q             chan chunk
+}
+
+func newDelayLine(p *NetworkProfile, rate int64) *delayLine {
+	return &delayLine{p: p, rate: rate, q: make(chan chunk, 64)}
+}
+
+// quantum is the most data sent at once, so that the rate is smooth
+func (l *delayLine) quantum() int {
+	if l.rate <= 0 || l.rate > 320*1024 {
+		return 32 * 1024
+	}
+	if l.rate < 5120 {
+		return 512
+	}
+	return int(l.rate / 10)
+}
+
+// send transmits b, returning false if abort was closed meanwhile
+func (l *delayLine) send(b []byte, abort <-chan struct{}) bool {
+	for len(b) > 0 {
+		n := len(b)
+		if q := l.quantum(); n > q {
+			n = q
+		}
+		now := time.Now()
+		end := now
+		if l.next.After(now) {
+			end = l.next
+		}
+		if l.rate > 0 {
+			end = end.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+		}
+		l.next = end
+		due := end.Add(l.p.delay())
+		if due.Before(l.lastDue) {
+			due = l.lastDue
+		}
+		l.lastDue = due
+		if !sleepUntil(end, abort) {
+			return false
+		}
+		select {
+		case l.q <- chunk{b: append([]byte(nil), b[:n]...), due: due}:
+		case <-abort:
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
+
+// end sends err after the data sent so far
+func (l *delayLine) end(err error, abort <-chan struct{}) {
+	due := time.Now().Add(l.p.delay())
+	if due.Before(l.lastDue) {
+		due = l.lastDue
+	}
+	select {
+	case l.q <- chunk{err: err, due: due}:
+	case <-abort:
+	}
+}
+
+// sleepUntil returns false if abort is closed before t
+func sleepUntil(t time.Time, abort <-chan struct{}) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-abort:
+		return false
+	}
+}
+
+// shapeDial returns dial, with the connections it dials shaped by p as upstream connections
+func shapeDial(dial func(network, addr string) (net.Conn, error), p *NetworkProfile) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		c, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return shapeConn(c, p, true), nil
+	}
+}
+
+// maxShapedTransports is the number of clones of Tr kept by shapedTransport, the least
+// recently used being dropped
+const maxShapedTransports = 16
+
+// shapedTransportKey identifies the clones of a Transport dialing connections shaped by a
+// profile
+type shapedTransportKey struct {
+	tr *http.Transport
+	p  NetworkProfile
+}
+
+// shapedTransports are the clones of Tr shaping the upstream connections, see
+// shapedTransport
+type shapedTransports struct {
+	mu  sync.Mutex
+	trs map[shapedTransportKey]*shapedTransportEntry
+	// uses counts the calls to shapedTransport, telling which clone was used last
+	uses int64
+}
+
+type shapedTransportEntry struct {
+	tr   *http.Transport
+	used int64
+}
+
+// shapedTransport returns a clone of proxy.Tr whose connections are shaped by p. The
+// connections are kept apart from those of proxy.Tr, since they can only be reused for
+// the requests shaped by the same profile.
+func (proxy *ProxyHttpServer) shapedTransport(p *NetworkProfile) *http.Transport {
+	c := &proxy.shapedTransports
+	key := shapedTransportKey{proxy.Tr, *p}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.uses++
+	if e := c.trs[key]; e != nil {
+		e.used = c.uses
+		return e.tr
+	}
+	tr := proxy.Tr.Clone()
+	dial := tr.DialContext
+	if dial == nil && tr.Dial != nil {
+		dial = func(_ context.Context, network, addr string) (net.Conn, error) {
+			return proxy.Tr.Dial(network, addr)
+		}
+	} else if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	tr.Dial = nil
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return shapeConn(c, p, true), nil
+	}
+	if c.trs == nil {
+		c.trs = map[shapedTransportKey]*shapedTransportEntry{}
+	}
+	if len(c.trs) >= maxShapedTransports {
+		c.evictLocked()
+	}
+	c.trs[key] = &shapedTransportEntry{tr: tr, used: c.uses}
+	return tr
+}
+
+// evictLocked drops the clone used the least recently, closing its idle connections. The
+// requests it is sending go on.
+func (c *shapedTransports) evictLocked() {
+	var oldest shapedTransportKey
+	var e *shapedTransportEntry
+	for key, other := range c.trs {
+		if e == nil || other.used < e.used {
+			oldest, e = key, other
+		}
+	}
+	delete(c.trs, oldest)
+	e.tr.CloseIdleConnections()
+}
+
+// shapedConn is a client or upstream connection shaped by a NetworkProfile. What is read from it goes
+// through the in delay line, filled by pump, what is written to it through the out delay
+// line, emptied by flush. Read deadlines are handled by shapedConn, since pump reads from
+// the connection without deadlines.
+type shapedConn struct {
+	net.Conn
+	in, out *delayLine
+	// closing is closed by Close, flushed once the data written was sent or given up on
+	closing, flushed chan struct{}
+	closeOnce        sync.Once
+	maxDelay         time.Duration
+
+	rmu     sync.Mutex
+	head    *chunk
+	pending []byte
+
+	dmu          sync.Mutex
+	readDeadline time.Time
+	// deadline is closed when the read deadline changes
+	deadline chan struct{}
+
+	wmu  sync.Mutex
+	werr error
+}
+
+func (c *shapedConn) pump() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := c.Conn.Read(buf)
+		if n > 0 && !c.in.send(buf[:n], c.closing) {
+			return
+		}
+		if err != nil {
+			c.in.end(err, c.closing)
+			return
+		}
+	}
+}
+
+func (c *shapedConn) flush() {
+	defer close(c.flushed)
+	deliver := func(ch chunk) bool {
+		sleepUntil(ch.due, nil)
+		if _, err := c.Conn.Write(ch.b); err != nil {
+			c.wmu.Lock()
+			c.werr = err
+			c.wmu.Unlock()
+			return false
+		}
+		return true
+	}
+	for {
+		select {
+		case ch := <-c.out.q:
+			if !deliver(ch) {
+				return
+			}
+		case <-c.closing:
+			for {
+				select {
+				case ch := <-c.out.q:
+					if !deliver(ch) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *shapedConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.pending) == 0 {
+		if c.head == nil {
+			var ch chunk
+			if err := c.waitRead(func(timeout <-chan time.Time, changed chan struct{}) (bool, error) {
+				select {
+				case ch = <-c.in.q:
+					return true, nil
+				case <-timeout:
+					return false, os.ErrDeadlineExceeded
+				case <-changed:
+					return false, nil
+				case <-c.closing:
+					return false, net.ErrClosed
+				}
+			}); err != nil {
+				return 0, err
+			}
+			c.head = &ch
+		}
+		if err := c.waitRead(func(timeout <-chan time.Time, changed chan struct{}) (bool, error) {
+			timer := time.NewTimer(time.Until(c.head.due))
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				return true, nil
+			case <-timeout:
+				return false, os.ErrDeadlineExceeded
+			case <-changed:
+				return false, nil
+			case <-c.closing:
+				return false, net.ErrClosed
+			}
+		}); err != nil {
+			return 0, err
+		}
+		if c.head.err != nil {
+			// the error stays at the head, for the next reads
+			return 0, c.head.err
+		}
+		c.pending, c.head = c.head.b, nil
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// waitRead calls wait with the read deadline, until it returns true or an error. It is
+// called again when the deadline changes.
+func (c *shapedConn) waitRead(wait func(timeout <-chan time.Time, changed chan struct{}) (bool, error)) error {
+	for {
+		c.dmu.Lock()
+		deadline, changed := c.readDeadline, c.deadline
+		c.dmu.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		ok, err := wait(timeout, changed)
+		if timer != nil {
+			timer.Stop()
+		}
+		if ok || err != nil {
+			return err
+		}
+	}
+}
+
+func (c *shapedConn) SetReadDeadline(t time.Time) error {
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	c.readDeadline = t
+	close(c.deadline)
+	c.deadline = make(chan struct{})
+	return nil
+}
+
+func (c *shapedConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *shapedConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	err := c.werr
+	c.wmu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if !c.out.send(b, c.closing) {
+		return 0, net.ErrClosed
+	}
+	return len(b), nil
+}
+
+// Close sends the data written so far, waiting for it at most the latency, before closing
+// the connection
+func (c *shapedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		timer := time.NewTimer(c.maxDelay + time.Second)
+		defer timer.Stop()
+		select {
+		case <-c.flushed:
+		case <-timer.C:
+		}
+	})
+	return c.Conn.Close()
+}
+
+// shapedBody throttles the body of a request or a response sent directly to the proxy,
+// until ctx is done
+type shapedBody struct {
+	io.ReadCloser
+	line *delayLine
+	ctx  context.Context
+}
+
+func shapeBody(ctx context.Context, body io.ReadCloser, p *NetworkProfile, rate int64) io.ReadCloser {
+	if body == nil || body == http.NoBody {
+		return body
+	}
+	return &shapedBody{ReadCloser: body, line: newDelayLine(p, rate), ctx: ctx}
+}
+
+func (b *shapedBody) Read(p []byte) (int, error) {
+	if q := b.line.quantum(); len(p) > q {
+		p = p[:q]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.line.rate > 0 {
+		now := time.Now()
+		if b.line.next.Before(now) {
+			b.line.next = now
+		}
+		b.line.next = b.line.next.Add(time.Duration(int64(n) * int64(time.Second) / b.line.rate))
+		if !sleepUntil(b.line.next, b.ctx.Done()) {
+			return n, b.ctx.Err()
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,30 @@
+package goproxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestShapedTransportsBounded(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	used := proxy.shapedTransport(&NetworkProfile{Down: 1})
+	var idle *http.Transport
+	for i := 0; i < maxShapedTransports; i++ {
+		if proxy.shapedTransport(&NetworkProfile{Down: 1}) != used {
+			t.Fatal("the clone of a profile should be reused")
+		}
+		tr := proxy.shapedTransport(&NetworkProfile{Down: int64(i + 2)})
+		if i == 0 {
+			idle = tr
+		}
+	}
+	if n := len(proxy.shapedTransports.trs); n != maxShapedTransports {
+		t.Error("Expected the clones to be bounded, got", n)
+	}
+	if proxy.shapedTransport(&NetworkProfile{Down: 1}) != used {
+		t.Error("the clone used recently should be kept")
+	}
+	if proxy.shapedTransport(&NetworkProfile{Down: 2}) == idle {
+		t.Error("the clone used the least recently should be dropped")
+	}
+}
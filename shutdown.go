@@ -0,0 +1,181 @@
+package goproxy
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// sessionTracker keeps track of the client connections hijacked by the proxy, and of the
+// goroutines serving them, which the http.Server serving the proxy knows nothing about.
+type sessionTracker struct {
+	mu       sync.Mutex
+	conns    map[*trackedConn]bool
+	wg       sync.WaitGroup
+	shutdown bool
+	// base is the parent of all the contexts of the proxy, cancelled on forced shutdown
+	base       context.Context
+	cancelBase context.CancelFunc
+}
+
+// trackedConn is a hijacked client connection. It is tracked until it is closed.
+type trackedConn struct {
+	net.Conn
+	t      *sessionTracker
+	once   sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
+	isIdle bool
+	// onShutdown, if set, is called instead of closing the idle connection on shutdown
+	onShutdown func()
+}
+
+// newContext returns a context derived from parent, which is also cancelled if the proxy
+// is forcibly shut down
+func (t *sessionTracker) newContext(parent context.Context) (context.Context, context.CancelFunc) {
+	t.mu.Lock()
+	if t.base == nil {
+		t.base, t.cancelBase = context.WithCancel(context.Background())
+	}
+	base := t.base
+	t.mu.Unlock()
+	ctx, cancel := context.WithCancel(parent)
+	stop := context.AfterFunc(base, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// track starts tracking c, whose session context, derived from parent, is cancelled when
+// c is closed. It returns false if the proxy is shutting down, in which case the caller
+// should close c without serving it.
+func (t *sessionTracker) track(parent context.Context, c net.Conn) (*trackedConn, bool) {
+	ctx, cancel := t.newContext(parent)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.shutdown {
+		cancel()
+		return nil, false
+	}
+	if t.conns == nil {
+		t.conns = make(map[*trackedConn]bool)
+	}
+	tc := &trackedConn{Conn: c, t: t, ctx: ctx, cancel: cancel}
+	t.conns[tc] = true
+	t.wg.Add(1)
+	return tc, true
+}
+
+// goFunc runs f in a new goroutine, that Shutdown will wait for
+func (t *sessionTracker) goFunc(f func()) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		f()
+	}()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.t.mu.Lock()
+		delete(c.t.conns, c)
+		c.t.mu.Unlock()
+		c.t.wg.Done()
+		c.cancel()
+	})
+	c.t.mu.Lock()
+	conn := c.Conn
+	c.t.mu.Unlock()
+	return conn.Close()
+}
+
+// wrap replaces the connection with f(connection), before it is used by other goroutines
+// than Shutdown
+func (c *trackedConn) wrap(f func(net.Conn) net.Conn) {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+	c.Conn = f(c.Conn)
+}
+
+// idle marks the connection as waiting for the next request from the client. It returns
+// false if the proxy is shutting down, in which case no more requests should be read.
+func (c *trackedConn) idle() bool {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+	c.isIdle = true
+	return !c.t.shutdown
+}
+
+// idleUntil marks the connection as idle until proxy shutdown, when f is called to shut
+// it down gracefully. It returns false if the proxy is already shutting down.
+func (c *trackedConn) idleUntil(f func()) bool {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+	c.isIdle = true
+	c.onShutdown = f
+	return !c.t.shutdown
+}
+
+// active marks the connection as serving a request, which Shutdown will wait for
+func (c *trackedConn) active() {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+	c.isIdle = false
+}
+
+// Shutdown gracefully shuts down the connections hijacked by the proxy: CONNECT tunnels,
+// man in the middle'd sessions and connections passed to Hijack functions. New sessions
+// are refused, idle man in the middle'd connections are closed, and requests in progress
+// are allowed to finish. Once ctx is done, the remaining connections are closed, the
+// contexts of the requests still in progress are cancelled, and Shutdown returns ctx.Err().
+//
+// Connections which were not hijacked are managed by the http.Server serving the proxy,
+// so http.Server.Shutdown should be called as well.
+func (proxy *ProxyHttpServer) Shutdown(ctx context.Context) error {
+	t := &proxy.sessions
+	t.mu.Lock()
+	t.shutdown = true
+	var idle []*trackedConn
+	var shutdowns []func()
+	for c := range t.conns {
+		if c.isIdle && c.onShutdown != nil {
+			shutdowns = append(shutdowns, c.onShutdown)
+		} else if c.isIdle {
+			idle = append(idle, c)
+		}
+	}
+	t.mu.Unlock()
+	for _, c := range idle {
+		c.Close()
+	}
+	for _, f := range shutdowns {
+		go f()
+	}
+
+	done := make(chan bool)
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	defer proxy.Tr.CloseIdleConnections()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	t.mu.Lock()
+	var remaining []*trackedConn
+	for c := range t.conns {
+		remaining = append(remaining, c)
+	}
+	if t.cancelBase != nil {
+		t.cancelBase()
+	}
+	t.mu.Unlock()
+	proxy.Logger.Printf("Shutdown deadline reached, closing %d connections", len(remaining))
+	for _, c := range remaining {
+		c.Close()
+	}
+	return ctx.Err()
+}
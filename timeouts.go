@@ -0,0 +1,287 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Timeouts bounds how long each phase of proxying can take. Zero means no timeout.
+// The timeouts of ProxyHttpServer can be overridden by a ConnectAction for a whole CONNECT
+// session, or by a ReqHandler for a single request, by changing ctx.Timeouts.
+type Timeouts struct {
+	// Dial bounds connecting to the upstream server, for requests and CONNECT tunnels
+	Dial time.Duration
+	// TLSHandshake bounds the TLS handshakes with man in the middle'd clients and with
+	// upstream servers
+	TLSHandshake time.Duration
+	// ResponseHeader bounds waiting for the response headers, once the request was sent
+	ResponseHeader time.Duration
+	// Body bounds reading the whole response body, once the headers were received
+	Body time.Duration
+	// IdleTunnel closes CONNECT tunnels and upgraded connections when no data was sent
+	// in either direction for that long
+	IdleTunnel time.Duration
+}
+
+// TimeoutPhase is the phase of proxying that timed out
+type TimeoutPhase string
+
+const (
+	TimeoutDial           TimeoutPhase = "dial"
+	TimeoutTLSHandshake   TimeoutPhase = "TLS handshake"
+	TimeoutResponseHeader TimeoutPhase = "response header"
+	TimeoutBody           TimeoutPhase = "response body"
+	TimeoutIdleTunnel     TimeoutPhase = "idle tunnel"
+)
+
+// TimeoutError is the error of a phase of proxying which timed out. It is set in ctx.Error
+// wrapped in a ProxyError of kind ErrorTimeout.
+type TimeoutError struct {
+	Phase    TimeoutPhase
+	Duration time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timeout after %v", e.Phase, e.Duration)
+}
+
+// Timeout is true, so that TimeoutError is a net.Error
+func (e *TimeoutError) Timeout() bool   { return true }
+func (e *TimeoutError) Temporary() bool { return true }
+
+// asTimeout returns a TimeoutError for phase if err is due to a deadline of d
+func asTimeout(err error, phase TimeoutPhase, d time.Duration) error {
+	if d > 0 && (errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded)) {
+		return &TimeoutError{phase, d}
+	}
+	return err
+}
+
+// setReadTimeout makes reads from c fail once d passed, or never if d is zero
+func setReadTimeout(c net.Conn, d time.Duration) {
+	var deadline time.Time
+	if d > 0 {
+		deadline = time.Now().Add(d)
+	}
+	c.SetReadDeadline(deadline)
+}
+
+// dialTimeout calls dial, giving up after d. If the dial completes afterwards, the
+// connection is closed.
+func dialTimeout(dial func(network, addr string) (net.Conn, error), network, addr string, d time.Duration) (net.Conn, error) {
+	if d <= 0 {
+		return dial(network, addr)
+	}
+	type result struct {
+		c   net.Conn
+		err error
+		// panicked is the value of a panic of dial, to panic with in the calling goroutine
+		panicked interface{}
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				done <- result{panicked: v}
+			}
+		}()
+		c, err := dial(network, addr)
+		done <- result{c, err, nil}
+	}()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		if r.panicked != nil {
+			panic(r.panicked)
+		}
+		return r.c, r.err
+	case <-timer.C:
+		go func() {
+			if r := <-done; r.c != nil {
+				r.c.Close()
+			}
+		}()
+		return nil, &TimeoutError{TimeoutDial, d}
+	}
+}
+
+// tlsHandshake runs the handshake of c, giving up after d
+func tlsHandshake(ctx context.Context, c *tls.Conn, d time.Duration) error {
+	if d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	return asTimeout(c.HandshakeContext(ctx), TimeoutTLSHandshake, d)
+}
+
+// roundTrip calls rt with a request whose context is cancelled when a phase of the round
+// trip times out. The timeouts are tracked through httptrace, so rt must honor the
+// request context and the client trace, as http.Transport does.
+func (t Timeouts) roundTrip(req *http.Request, rt func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if t.Dial <= 0 && t.TLSHandshake <= 0 && t.ResponseHeader <= 0 && t.Body <= 0 {
+		return rt(req)
+	}
+	reqCtx, cancel := context.WithCancel(req.Context())
+	p := &phaseTimer{cancel: cancel}
+	trace := &httptrace.ClientTrace{
+		ConnectStart:         func(string, string) { p.start(TimeoutDial, t.Dial) },
+		ConnectDone:          func(string, string, error) { p.stop() },
+		TLSHandshakeStart:    func() { p.start(TimeoutTLSHandshake, t.TLSHandshake) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { p.stop() },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { p.start(TimeoutResponseHeader, t.ResponseHeader) },
+		GotFirstResponseByte: func() { p.stop() },
+	}
+	resp, err := rt(req.WithContext(httptrace.WithClientTrace(reqCtx, trace)))
+	if err != nil {
+		p.stop()
+		cancel()
+		return nil, p.err(err)
+	}
+	p.start(TimeoutBody, t.Body)
+	resp.Body = &timeoutBody{resp.Body, p}
+	return resp, nil
+}
+
+// phaseTimer cancels a round trip when its current phase takes too long
+type phaseTimer struct {
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	timer  *time.Timer
+	// gen tells apart the current timer from stopped ones which fired anyway
+	gen   int
+	fired *TimeoutError
+}
+
+func (p *phaseTimer) start(phase TimeoutPhase, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopLocked()
+	if d <= 0 || p.fired != nil {
+		return
+	}
+	gen := p.gen
+	p.timer = time.AfterFunc(d, func() {
+		p.mu.Lock()
+		if gen != p.gen {
+			p.mu.Unlock()
+			return
+		}
+		p.fired = &TimeoutError{phase, d}
+		p.mu.Unlock()
+		p.cancel()
+	})
+}
+
+func (p *phaseTimer) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopLocked()
+}
+
+func (p *phaseTimer) stopLocked() {
+	p.gen++
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+}
+
+// err returns the TimeoutError if a phase timed out, err otherwise
+func (p *phaseTimer) err(err error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fired != nil {
+		return p.fired
+	}
+	return err
+}
+
+// timeoutBody is a response body read with a timeout
+type timeoutBody struct {
+	io.ReadCloser
+	p *phaseTimer
+}
+
+func (b *timeoutBody) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(buf)
+	if err != nil && err != io.EOF {
+		err = b.p.err(err)
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	b.p.stop()
+	err := b.ReadCloser.Close()
+	b.p.cancel()
+	return err
+}
+
+// idleTimeout closes conns when no data was read from any of them for d. It returns the
+// connections to use for the reads to count, and the timer telling whether they were closed
+// when idle, nil if d is not positive.
+func idleTimeout(ctx *ProxyCtx, d time.Duration, conns ...net.Conn) ([]net.Conn, *idleTimer) {
+	if d <= 0 {
+		return conns, nil
+	}
+	t := &idleTimer{d: d}
+	t.timer = time.AfterFunc(d, func() {
+		t.fired.Store(true)
+		ctx.Warnf("Closing tunnel idle for %v", d)
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	wrapped := make([]net.Conn, len(conns))
+	for i, c := range conns {
+		wrapped[i] = &idleConn{c, t}
+	}
+	return wrapped, t
+}
+
+type idleTimer struct {
+	d       time.Duration
+	timer   *time.Timer
+	stopped atomic.Bool
+	fired   atomic.Bool
+}
+
+// err returns the error of a tunnel closed when idle, nil if it was not. t may be nil.
+func (t *idleTimer) err() error {
+	if t == nil || !t.fired.Load() {
+		return nil
+	}
+	return &ProxyError{ErrorTimeout, &TimeoutError{TimeoutIdleTunnel, t.d}}
+}
+
+// idleConn is a connection of a tunnel closed when idle, see idleTimeout
+type idleConn struct {
+	net.Conn
+	t *idleTimer
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && !c.t.stopped.Load() {
+		c.t.timer.Reset(c.t.d)
+	}
+	return n, err
+}
+
+func (c *idleConn) Close() error {
+	c.t.stopped.Store(true)
+	c.t.timer.Stop()
+	return c.Conn.Close()
+}
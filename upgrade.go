@@ -0,0 +1,248 @@
+package goproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isUpgradeRequest reports whether the client asks to switch protocols, as done in
+// a WebSocket handshake.
+func isUpgradeRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && headerHasToken(r.Header, "Connection", "upgrade")
+}
+
+// headerHasToken reports whether the comma separated list in header name contains token
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dialUpstream opens a connection to the destination of req, using TLS for https and wss,
+// with the timeouts and the network profile of ctx
+func (proxy *ProxyHttpServer) dialUpstream(req *http.Request, ctx *ProxyCtx) (net.Conn, error) {
+	t := ctx.Timeouts
+	dial, connectDial := proxy.dial, proxy.connectDial
+	if p := ctx.Network; p != nil {
+		dial, connectDial = shapeDial(dial, p.leg()), shapeDial(connectDial, p.leg())
+	}
+	host := req.URL.Host
+	secure := req.URL.Scheme == "https" || req.URL.Scheme == "wss"
+	if !hasPort.MatchString(host) {
+		if secure {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+	if !secure {
+		return dialTimeout(dial, "tcp", host, t.Dial)
+	}
+	c, err := dialTimeout(connectDial, "tcp", host, t.Dial)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{}
+	if proxy.Tr.TLSClientConfig != nil {
+		config = proxy.Tr.TLSClientConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = stripPort(host)
+	}
+	tlsConn := tls.Client(c, config)
+	if err := tlsHandshake(req.Context(), tlsConn, t.TLSHandshake); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// upgradeRoundTrip sends an upgrade request over a dedicated connection, since the
+// connection can't be reused once protocols are switched. If the upstream server agreed
+// to switch protocols, the connection is returned with the response, otherwise the
+// connection is closed with the response body. Like other requests, it is sent to an
+// endpoint of ctx.Upstream if set, through its circuit breaker, but it is not retried,
+// and ctx.RoundTripper and the RoundTripHandlers are not used for upgrade requests.
+func (proxy *ProxyHttpServer) upgradeRoundTrip(req *http.Request, ctx *ProxyCtx) (*http.Response, net.Conn, error) {
+	var upstream net.Conn
+	resp, err := sendUpstream(req, ctx, func(req *http.Request) (*http.Response, error) {
+		resp, c, err := proxy.upgrade(req, ctx)
+		upstream = c
+		return resp, err
+	})
+	return resp, upstream, err
+}
+
+// upgrade sends an upgrade request, see upgradeRoundTrip
+func (proxy *ProxyHttpServer) upgrade(req *http.Request, ctx *ProxyCtx) (*http.Response, net.Conn, error) {
+	ctx.Logf("Sending upgrade request to %v", req.URL.Host)
+	var c net.Conn
+	var err error
+	if ctx.tunnel.serves(req) {
+		c, _, err = ctx.tunnel.take()
+	} else {
+		c, err = proxy.dialUpstream(req, ctx)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	br := bufio.NewReader(c)
+	setReadTimeout(c, ctx.Timeouts.ResponseHeader)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, nil, asTimeout(err, TimeoutResponseHeader, ctx.Timeouts.ResponseHeader)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// the request is not sent through http.Transport, so the body timeout is applied
+		// to the connection
+		setReadTimeout(c, ctx.Timeouts.Body)
+		resp.Body = &connClosingBody{resp.Body, c, ctx.Timeouts.Body}
+		return resp, nil, nil
+	}
+	setReadTimeout(c, 0)
+	return resp, &bufferedConn{c, br}, nil
+}
+
+// serveUpgraded hijacks the client connection of a plain proxy request, and tunnels
+// it to upstream after sending the client the switching protocols response.
+func (proxy *ProxyHttpServer) serveUpgraded(w http.ResponseWriter, req *http.Request, resp *http.Response, upstream net.Conn, ctx *ProxyCtx) {
+	hij, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		ctx.Warnf("Cannot switch protocols, httpserver does not support hijacking")
+		http.Error(w, "Cannot switch protocols", http.StatusBadGateway)
+		return
+	}
+	conn, buf, err := hij.Hijack()
+	if err != nil {
+		upstream.Close()
+		ctx.Warnf("Cannot hijack connection to switch protocols: %v", err)
+		return
+	}
+	client, ok := proxy.sessions.track(ctx.Context(), &bufferedConn{conn, buf.Reader})
+	if !ok {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	switchProtocols(ctx, req, client, upstream, resp)
+}
+
+// switchProtocols writes the switching protocols response to the client, and splices
+// the client and the upstream connections until one of them is closed. WebSocket
+// connections are relayed message by message if there are WebSocket handlers. ctx.Error is
+// set once they are closed if they were idle for too long.
+func switchProtocols(ctx *ProxyCtx, req *http.Request, client, upstream net.Conn, resp *http.Response) {
+	ctx.Logf("Switching protocols to %v", resp.Header.Get("Upgrade"))
+	if err := writeResponseHead(client, resp); err != nil {
+		ctx.Warnf("Cannot write switching protocols response to client: %v", err)
+		client.Close()
+		upstream.Close()
+		return
+	}
+	conns, idle := idleTimeout(ctx, ctx.Timeouts.IdleTunnel, client, upstream)
+	client, upstream = conns[0], conns[1]
+	defer func() {
+		if err := idle.err(); err != nil {
+			ctx.Error = err
+		}
+	}()
+	if strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") && len(ctx.proxy.handlers.load().ws) > 0 {
+		if clientDeflate, serverDeflate, ok := parseWSExtensions(resp.Header); ok {
+			ctx.Req, ctx.Resp = req, resp
+			ctx.proxy.pumpWebSocket(ctx, client, upstream, clientDeflate, serverDeflate)
+			return
+		}
+		ctx.Warnf("Unsupported websocket extensions %v, messages will not be handled",
+			resp.Header.Get("Sec-WebSocket-Extensions"))
+	}
+	splice(ctx, client, upstream)
+}
+
+// writeResponseHead writes the status line and the headers of resp, without the body
+func writeResponseHead(w io.Writer, resp *http.Response) error {
+	statusCode := strconv.Itoa(resp.StatusCode) + " "
+	text := strings.TrimPrefix(resp.Status, statusCode)
+	if text == "" {
+		text = http.StatusText(resp.StatusCode)
+	}
+	if _, err := io.WriteString(w, "HTTP/1.1 "+statusCode+text+"\r\n"); err != nil {
+		return err
+	}
+	if err := resp.Header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// splice copies data in both directions between a and b. When either direction is
+// done, both connections are closed. splice returns when both directions are done.
+func splice(ctx *ProxyCtx, a, b net.Conn) {
+	done := make(chan bool, 2)
+	cp := func(w, r net.Conn) {
+		if _, err := io.Copy(w, r); err != nil && !isClosedConnError(err) {
+			ctx.Warnf("Error copying upgraded connection: %s", err)
+		}
+		done <- true
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+func isClosedConnError(err error) bool {
+	return err == io.EOF || err == io.ErrClosedPipe || errors.Is(err, net.ErrClosed)
+}
+
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader, holding data
+// already read from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// connClosingBody closes the connection a response was read from with its body, which
+// times out after d
+type connClosingBody struct {
+	io.ReadCloser
+	c net.Conn
+	d time.Duration
+}
+
+func (b *connClosingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	return n, asTimeout(err, TimeoutBody, b.d)
+}
+
+func (b *connClosingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if cerr := b.c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
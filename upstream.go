@@ -0,0 +1,503 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoEndpoint is the error of the requests sent to a Pool none of whose endpoints is
+// healthy
+var ErrNoEndpoint = errors.New("no healthy endpoint")
+
+// An Endpoint is a server of a Pool
+type Endpoint struct {
+	// URL is the scheme and host the requests are sent to
+	URL *url.URL
+	// Weight is the share of the requests the endpoint gets relative to the others, for the
+	// balancers which take it into account. Zero is the same as 1.
+	Weight int
+	pool   *Pool
+	// the requests sent to the endpoint whose response body is not closed yet
+	active int64
+	mu     sync.Mutex
+	// consecutive failed requests, and until when the endpoint is ejected for them
+	failures     int
+	ejectedUntil time.Time
+	// whether the endpoint failed its health checks, and the consecutive checks telling
+	// otherwise
+	down   bool
+	checks int
+}
+
+func (e *Endpoint) String() string {
+	return e.URL.String()
+}
+
+func (e *Endpoint) weight() int {
+	if e.Weight <= 0 {
+		return 1
+	}
+	return e.Weight
+}
+
+// ActiveRequests returns the number of requests the endpoint is serving
+func (e *Endpoint) ActiveRequests() int {
+	return int(atomic.LoadInt64(&e.active))
+}
+
+// Healthy reports whether the endpoint passes its health checks and is not ejected for
+// failing requests
+func (e *Endpoint) Healthy() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !e.down && !time.Now().Before(e.ejectedUntil)
+}
+
+// rewrite returns a copy of req directed to the endpoint
+func (e *Endpoint) rewrite(req *http.Request) *http.Request {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = e.URL.Scheme, e.URL.Host
+	if !e.pool.PreserveHost {
+		req.Host = e.URL.Host
+	}
+	return req
+}
+
+// roundTrip sends req to the endpoint with send, the endpoint being nil if req is not sent
+// to a Pool, recording the result for the outlier detection
+func (e *Endpoint) roundTrip(req *http.Request, ctx *ProxyCtx, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if e == nil {
+		return send(req)
+	}
+	atomic.AddInt64(&e.active, 1)
+	resp, err := send(req)
+	if req.Context().Err() == nil {
+		e.observe(err == nil && resp.StatusCode < 500, ctx)
+	}
+	if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		atomic.AddInt64(&e.active, -1)
+	} else {
+		resp.Body = &endpointBody{ReadCloser: resp.Body, e: e}
+	}
+	return resp, err
+}
+
+// observe records the outcome of a request, ejecting the endpoint after too many failures
+func (e *Endpoint) observe(ok bool, ctx *ProxyCtx) {
+	o := e.pool.Outliers
+	if o == nil || o.ConsecutiveFailures <= 0 {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if ok {
+		e.failures = 0
+		return
+	}
+	if e.failures++; e.failures >= o.ConsecutiveFailures {
+		e.failures = 0
+		e.ejectedUntil = time.Now().Add(o.EjectionTime)
+		ctx.Warnf("Ejecting endpoint %v of pool %v for %v", e, e.pool.Name, o.EjectionTime)
+	}
+}
+
+// endpointBody releases its endpoint once read or closed
+type endpointBody struct {
+	io.ReadCloser
+	e    *Endpoint
+	once sync.Once
+}
+
+func (b *endpointBody) release() {
+	b.once.Do(func() { atomic.AddInt64(&b.e.active, -1) })
+}
+
+func (b *endpointBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.release()
+	}
+	return n, err
+}
+
+func (b *endpointBody) Close() error {
+	b.release()
+	return b.ReadCloser.Close()
+}
+
+// A Balancer picks the endpoint a request is sent to, among the healthy endpoints of a
+// Pool
+type Balancer interface {
+	Pick(req *http.Request, endpoints []*Endpoint) *Endpoint
+}
+
+type roundRobin struct{ n uint64 }
+
+// RoundRobin returns a Balancer sending the requests to each endpoint in turn
+func RoundRobin() Balancer {
+	return &roundRobin{}
+}
+
+func (b *roundRobin) Pick(req *http.Request, endpoints []*Endpoint) *Endpoint {
+	return endpoints[(atomic.AddUint64(&b.n, 1)-1)%uint64(len(endpoints))]
+}
+
+type leastConn struct{ roundRobin }
+
+// LeastConn returns a Balancer sending the requests to the endpoint serving the fewest
+// requests relative to its weight. Ties are broken in turn.
+func LeastConn() Balancer {
+	return &leastConn{}
+}
+
+func (b *leastConn) Pick(req *http.Request, endpoints []*Endpoint) *Endpoint {
+	start := int(atomic.AddUint64(&b.n, 1) % uint64(len(endpoints)))
+	var best *Endpoint
+	for i := range endpoints {
+		e := endpoints[(start+i)%len(endpoints)]
+		if best == nil || e.ActiveRequests()*best.weight() < best.ActiveRequests()*e.weight() {
+			best = e
+		}
+	}
+	return best
+}
+
+type weighted struct {
+	mu      sync.Mutex
+	current map[*Endpoint]int
+}
+
+// Weighted returns a Balancer sending the requests to the endpoints in turn, in proportion
+// to their weights. The requests of an endpoint are interleaved with the others rather than
+// sent in a row, as nginx does.
+func Weighted() Balancer {
+	return &weighted{current: map[*Endpoint]int{}}
+}
+
+func (b *weighted) Pick(req *http.Request, endpoints []*Endpoint) *Endpoint {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.current) > 2*len(endpoints) {
+		// forget the endpoints which were removed
+		b.current = map[*Endpoint]int{}
+	}
+	var best *Endpoint
+	total := 0
+	for _, e := range endpoints {
+		b.current[e] += e.weight()
+		total += e.weight()
+		if best == nil || b.current[e] > b.current[best] {
+			best = e
+		}
+	}
+	b.current[best] -= total
+	return best
+}
+
+type consistentHash struct {
+	key      func(req *http.Request) string
+	fallback roundRobin
+}
+
+// ConsistentHash returns a Balancer sending the requests with the same key to the same
+// endpoint, so that sessions stick to an endpoint. When endpoints are added, removed or
+// ejected, only the keys of these endpoints move. Requests without a key are sent in turn.
+//	pool := goproxy.NewPool("app", goproxy.ConsistentHash(goproxy.HashCookie("session")))
+func ConsistentHash(key func(req *http.Request) string) Balancer {
+	return &consistentHash{key: key}
+}
+
+// HashCookie returns the key of ConsistentHash reading the cookie name of the requests
+func HashCookie(name string) func(req *http.Request) string {
+	return func(req *http.Request) string {
+		if c, err := req.Cookie(name); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+}
+
+// HashHeader returns the key of ConsistentHash reading the header name of the requests
+func HashHeader(name string) func(req *http.Request) string {
+	return func(req *http.Request) string {
+		return req.Header.Get(name)
+	}
+}
+
+// Pick does weighted rendezvous hashing: each endpoint gets a score from the hash of the
+// key and its own URL, and the highest score wins
+func (b *consistentHash) Pick(req *http.Request, endpoints []*Endpoint) *Endpoint {
+	key := b.key(req)
+	if key == "" {
+		return b.fallback.Pick(req, endpoints)
+	}
+	var best *Endpoint
+	bestScore := math.Inf(-1)
+	for _, e := range endpoints {
+		h := fnv.New64a()
+		io.WriteString(h, key)
+		io.WriteString(h, e.URL.String())
+		// mixed so that keys differing by their last bytes spread, and mapped to a uniform
+		// number in (0, 1)
+		x := h.Sum64()
+		x ^= x >> 33
+		x *= 0xff51afd7ed558ccd
+		x ^= x >> 33
+		u := (float64(x>>11) + 0.5) / (1 << 53)
+		if score := -float64(e.weight()) / math.Log(u); score > bestScore {
+			best, bestScore = e, score
+		}
+	}
+	return best
+}
+
+// OutlierDetection ejects the endpoints of a Pool failing too many requests in a row, that
+// is requests which could not be sent, or were answered with a 5xx status
+type OutlierDetection struct {
+	ConsecutiveFailures int
+	// EjectionTime is how long an endpoint is ejected for, after which it is sent requests
+	// again
+	EjectionTime time.Duration
+}
+
+// HealthCheck probes the endpoints of a Pool periodically, with a GET request to Path. An
+// endpoint answering with a 2xx or 3xx status is healthy.
+type HealthCheck struct {
+	Path     string
+	Interval time.Duration
+	// Timeout is how long a probe may take, Interval if zero
+	Timeout time.Duration
+	// Healthy and Unhealthy are the number of checks in a row which mark an endpoint up
+	// and down, 1 if zero
+	Healthy, Unhealthy int
+	// Client sends the probes, a client with Timeout if nil
+	Client *http.Client
+}
+
+// check probes e, updating its health
+func (hc *HealthCheck) check(e *Endpoint, client *http.Client) {
+	u := *e.URL
+	u.Path, u.RawQuery = hc.Path, ""
+	ok := false
+	if resp, err := client.Get(u.String()); err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		ok = resp.StatusCode < 400
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	threshold := hc.Unhealthy
+	if e.down {
+		threshold = hc.Healthy
+	}
+	if ok != e.down {
+		e.checks = 0
+		return
+	}
+	if e.checks++; e.checks >= threshold {
+		e.down, e.checks = !ok, 0
+	}
+}
+
+// A Pool is a set of servers requests for the same upstream are spread across. A request is
+// sent to a pool by setting ctx.Upstream to the name of the pool in proxy.Pools, from a
+// ReqHandler. The path of the request is kept, and its host is replaced with the one of the
+// endpoint picked by the Balancer.
+//	pool := goproxy.NewPool("api", goproxy.LeastConn())
+//	pool.Add("http://10.0.0.7:8080", 1)
+//	pool.Add("http://10.0.0.8:8080", 2)
+//	pool.Outliers = &goproxy.OutlierDetection{ConsecutiveFailures: 5, EjectionTime: 30 * time.Second}
+//	proxy.Pools.Add(pool)
+//	proxy.OnRequest(goproxy.ReqHostIs("api.example.com")).DoFunc(
+//		func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+//			ctx.Upstream = "api"
+//			return r, nil
+//		})
+type Pool struct {
+	Name     string
+	Balancer Balancer
+	// PreserveHost keeps the Host header of the requests, instead of using the host of the
+	// endpoint
+	PreserveHost bool
+	// HealthCheck, if not nil, probes the endpoints while the pool is in a Pools
+	HealthCheck *HealthCheck
+	// Outliers, if not nil, ejects the endpoints failing requests
+	Outliers  *OutlierDetection
+	mu        sync.RWMutex
+	endpoints []*Endpoint
+	stop      chan struct{}
+}
+
+// NewPool returns a pool without endpoints, balancing the requests with balancer,
+// RoundRobin if nil
+func NewPool(name string, balancer Balancer) *Pool {
+	if balancer == nil {
+		balancer = RoundRobin()
+	}
+	return &Pool{Name: name, Balancer: balancer}
+}
+
+// Add adds the endpoint of URL rawurl to the pool
+func (p *Pool) Add(rawurl string, weight int) (*Endpoint, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.New("endpoint must be an absolute URL: " + rawurl)
+	}
+	e := &Endpoint{URL: u, Weight: weight, pool: p}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endpoints = append(p.endpoints, e)
+	return e, nil
+}
+
+// Remove removes e from the pool. Returns false if e was not found.
+func (p *Pool) Remove(e *Endpoint) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, other := range p.endpoints {
+		if other == e {
+			p.endpoints = append(p.endpoints[:i:i], p.endpoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Endpoints returns a copy of the endpoints of the pool, in the order they were added
+func (p *Pool) Endpoints() []*Endpoint {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*Endpoint(nil), p.endpoints...)
+}
+
+// pick returns the endpoint req is sent to
+func (p *Pool) pick(req *http.Request) (*Endpoint, error) {
+	var healthy []*Endpoint
+	for _, e := range p.Endpoints() {
+		if e.Healthy() {
+			healthy = append(healthy, e)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil, &ProxyError{ErrorNoEndpoint, fmt.Errorf("pool %v: %w", p.Name, ErrNoEndpoint)}
+	}
+	return p.Balancer.Pick(req, healthy), nil
+}
+
+// start runs the health checks of the pool until stopped
+func (p *Pool) start() {
+	hc := p.HealthCheck
+	if hc == nil || hc.Interval <= 0 {
+		return
+	}
+	p.stop = make(chan struct{})
+	client := hc.Client
+	if client == nil {
+		timeout := hc.Timeout
+		if timeout <= 0 {
+			timeout = hc.Interval
+		}
+		client = &http.Client{Timeout: timeout}
+	}
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(hc.Interval)
+		defer ticker.Stop()
+		for {
+			var wg sync.WaitGroup
+			for _, e := range p.Endpoints() {
+				wg.Add(1)
+				go func(e *Endpoint) {
+					defer wg.Done()
+					hc.check(e, client)
+				}(e)
+			}
+			wg.Wait()
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}(p.stop)
+}
+
+func (p *Pool) close() {
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
+
+// Pools holds the pools of a proxy by name. It is safe to modify it while the proxy is
+// serving requests.
+type Pools struct {
+	mu    sync.RWMutex
+	pools map[string]*Pool
+}
+
+// NewPools returns an empty set of pools
+func NewPools() *Pools {
+	return &Pools{pools: map[string]*Pool{}}
+}
+
+// Add registers pool under its name, replacing the pool of the same name if any, and starts
+// its health checks
+func (ps *Pools) Add(pool *Pool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if old := ps.pools[pool.Name]; old != nil && old != pool {
+		old.close()
+	}
+	if ps.pools[pool.Name] != pool {
+		pool.start()
+	}
+	ps.pools[pool.Name] = pool
+}
+
+// Remove removes the pool name and stops its health checks. Returns false if it was not
+// found.
+func (ps *Pools) Remove(name string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	pool := ps.pools[name]
+	if pool == nil {
+		return false
+	}
+	pool.close()
+	delete(ps.pools, name)
+	return true
+}
+
+// Get returns the pool name, or nil if there is none
+func (ps *Pools) Get(name string) *Pool {
+	if ps == nil {
+		return nil
+	}
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.pools[name]
+}
+
+// endpoint returns the endpoint of ctx.Upstream req is sent to, nil if req is not sent to
+// a pool
+func (ps *Pools) endpoint(req *http.Request, ctx *ProxyCtx) (*Endpoint, error) {
+	if ctx.Upstream == "" {
+		return nil, nil
+	}
+	pool := ps.Get(ctx.Upstream)
+	if pool == nil {
+		return nil, &ProxyError{ErrorProxy, errors.New("unknown pool " + ctx.Upstream)}
+	}
+	return pool.pick(req)
+}
@@ -0,0 +1,321 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Direction tells whether a WebSocket message was sent by the client or by the server
+type Direction int
+
+const (
+	ClientToServer Direction = iota
+	ServerToClient
+)
+
+func (d Direction) String() string {
+	if d == ClientToServer {
+		return "client->server"
+	}
+	return "server->client"
+}
+
+// WebSocket message types, as defined in RFC 6455
+const (
+	WSTextMessage   = 1
+	WSBinaryMessage = 2
+)
+
+// WSMessage is a complete WebSocket data message. Fragmented messages are reassembled,
+// and compressed messages are decompressed, before being passed to the handlers.
+type WSMessage struct {
+	// Type is either WSTextMessage or WSBinaryMessage
+	Type int
+	Data []byte
+}
+
+const (
+	wsContinuation = 0
+	wsClose        = 8
+	wsPing         = 9
+	wsPong         = 10
+)
+
+// maxWSMessageSize bounds the size of a single reassembled message
+const maxWSMessageSize = 32 << 20
+
+var errWSProtocol = errors.New("websocket protocol error")
+
+type wsFrame struct {
+	fin     bool
+	rsv1    bool
+	opcode  byte
+	payload []byte
+}
+
+func readWSFrame(r io.Reader) (*wsFrame, error) {
+	var h [8]byte
+	if _, err := io.ReadFull(r, h[:2]); err != nil {
+		return nil, err
+	}
+	f := &wsFrame{fin: h[0]&0x80 != 0, rsv1: h[0]&0x40 != 0, opcode: h[0] & 0x0f}
+	if h[0]&0x30 != 0 {
+		return nil, errWSProtocol
+	}
+	masked := h[1]&0x80 != 0
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		if _, err := io.ReadFull(r, h[:2]); err != nil {
+			return nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(h[:2]))
+	case 127:
+		if _, err := io.ReadFull(r, h[:8]); err != nil {
+			return nil, err
+		}
+		n = binary.BigEndian.Uint64(h[:8])
+	}
+	if n > maxWSMessageSize || (f.opcode >= wsClose && (n > 125 || !f.fin)) {
+		return nil, errWSProtocol
+	}
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return nil, err
+		}
+	}
+	f.payload = make([]byte, n)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		maskWSPayload(key, f.payload)
+	}
+	return f, nil
+}
+
+// writeWSFrame writes f to w. Frames sent by clients must be masked.
+func writeWSFrame(w io.Writer, f *wsFrame, mask bool) error {
+	h := make([]byte, 2, 14)
+	h[0] = f.opcode
+	if f.fin {
+		h[0] |= 0x80
+	}
+	if f.rsv1 {
+		h[0] |= 0x40
+	}
+	n := len(f.payload)
+	switch {
+	case n < 126:
+		h[1] = byte(n)
+	case n <= 0xffff:
+		h[1] = 126
+		h = append(h, byte(n>>8), byte(n))
+	default:
+		h[1] = 127
+		var l [8]byte
+		binary.BigEndian.PutUint64(l[:], uint64(n))
+		h = append(h, l[:]...)
+	}
+	payload := f.payload
+	if mask {
+		h[1] |= 0x80
+		var key [4]byte
+		if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+			return err
+		}
+		h = append(h, key[:]...)
+		payload = append([]byte(nil), payload...)
+		maskWSPayload(key, payload)
+	}
+	if _, err := w.Write(h); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func maskWSPayload(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+}
+
+// wsDeflate holds the permessage-deflate (RFC 7692) parameters negotiated for one direction
+type wsDeflate struct {
+	// the sender keeps its LZ77 window between messages
+	contextTakeover bool
+	// the receiver accepts messages compressed with a full 32K window
+	fullWindow bool
+	// the last 32K of uncompressed data received, used as the dictionary of the next message
+	window []byte
+}
+
+// wsTail terminates a compressed message: the sync flush marker removed by the sender
+// followed by an empty final block, so that the flate reader reports io.EOF.
+var wsTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+func (d *wsDeflate) inflate(b []byte) ([]byte, error) {
+	var dict []byte
+	if d.contextTakeover {
+		dict = d.window
+	}
+	fr := flate.NewReaderDict(io.MultiReader(bytes.NewReader(b), bytes.NewReader(wsTail)), dict)
+	defer fr.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(fr, maxWSMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxWSMessageSize {
+		return nil, errWSProtocol
+	}
+	if d.contextTakeover {
+		d.window = append(d.window, data...)
+		if len(d.window) > 1<<15 {
+			d.window = append([]byte(nil), d.window[len(d.window)-1<<15:]...)
+		}
+	}
+	return data, nil
+}
+
+// deflate compresses a message without referring to previous messages, so the
+// receiver can decompress it whatever its window holds.
+func (d *wsDeflate) deflate(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), wsTail[:4]), nil
+}
+
+// parseWSExtensions returns the permessage-deflate parameters for messages sent by the
+// client and by the server, or nils if it was not negotiated. ok is false when the server
+// agreed to an extension we don't understand.
+func parseWSExtensions(h http.Header) (client, server *wsDeflate, ok bool) {
+	for _, v := range h[http.CanonicalHeaderKey("Sec-WebSocket-Extensions")] {
+		for _, ext := range strings.Split(v, ",") {
+			params := strings.Split(ext, ";")
+			if strings.TrimSpace(params[0]) != "permessage-deflate" || client != nil {
+				return nil, nil, false
+			}
+			client = &wsDeflate{contextTakeover: true, fullWindow: true}
+			server = &wsDeflate{contextTakeover: true, fullWindow: true}
+			for _, p := range params[1:] {
+				kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+				bits := 15
+				if len(kv) == 2 {
+					bits, _ = strconv.Atoi(strings.Trim(kv[1], `"`))
+				}
+				switch kv[0] {
+				case "client_no_context_takeover":
+					client.contextTakeover = false
+				case "server_no_context_takeover":
+					server.contextTakeover = false
+				case "client_max_window_bits":
+					client.fullWindow = bits >= 15
+				case "server_max_window_bits":
+					server.fullWindow = bits >= 15
+				}
+			}
+		}
+	}
+	return client, server, true
+}
+
+func (proxy *ProxyHttpServer) filterWebSocketMessage(msg *WSMessage, dir Direction, ctx *ProxyCtx) *WSMessage {
+	for _, h := range proxy.handlers.load().ws {
+		if msg = h.HandleMessage(msg, dir, ctx); msg == nil {
+			break
+		}
+	}
+	return msg
+}
+
+// pumpWebSocket relays WebSocket frames between the client and upstream, passing every
+// data message through the WebSocket handlers. Control frames are relayed as is.
+func (proxy *ProxyHttpServer) pumpWebSocket(ctx *ProxyCtx, client, upstream net.Conn, clientDeflate, serverDeflate *wsDeflate) {
+	done := make(chan bool, 2)
+	pump := func(dir Direction, dst, src net.Conn, deflate *wsDeflate) {
+		defer func() { done <- true }()
+		defer proxy.recoverGoroutine(ctx)
+		if err := proxy.pumpWebSocketMessages(ctx, dir, dst, bufio.NewReader(src), deflate); err != nil && !isClosedConnError(err) {
+			ctx.Warnf("Error relaying websocket messages %v: %v", dir, err)
+		}
+	}
+	go pump(ClientToServer, upstream, client, clientDeflate)
+	go pump(ServerToClient, client, upstream, serverDeflate)
+	<-done
+	client.Close()
+	upstream.Close()
+	<-done
+}
+
+func (proxy *ProxyHttpServer) pumpWebSocketMessages(ctx *ProxyCtx, dir Direction, dst io.Writer, src io.Reader, deflate *wsDeflate) error {
+	mask := dir == ClientToServer
+	var msg *WSMessage
+	var compressed bool
+	for {
+		f, err := readWSFrame(src)
+		if err != nil {
+			return err
+		}
+		if f.opcode >= wsClose {
+			if err := writeWSFrame(dst, f, mask); err != nil {
+				return err
+			}
+			continue
+		}
+		if (f.opcode == wsContinuation) != (msg != nil) || (f.rsv1 && (deflate == nil || msg != nil)) {
+			return errWSProtocol
+		}
+		if msg == nil {
+			msg = &WSMessage{Type: int(f.opcode)}
+			compressed = f.rsv1
+		}
+		if len(msg.Data)+len(f.payload) > maxWSMessageSize {
+			return errWSProtocol
+		}
+		msg.Data = append(msg.Data, f.payload...)
+		if !f.fin {
+			continue
+		}
+		if compressed {
+			if msg.Data, err = deflate.inflate(msg.Data); err != nil {
+				return err
+			}
+		}
+		out := proxy.filterWebSocketMessage(msg, dir, ctx)
+		msg = nil
+		if out == nil {
+			continue
+		}
+		f = &wsFrame{fin: true, opcode: byte(out.Type), payload: out.Data}
+		if deflate != nil && deflate.fullWindow {
+			if f.payload, err = deflate.deflate(out.Data); err != nil {
+				return err
+			}
+			f.rsv1 = true
+		}
+		if err := writeWSFrame(dst, f, mask); err != nil {
+			return err
+		}
+	}
+}
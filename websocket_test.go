@@ -0,0 +1,119 @@
+package goproxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// writeFrames writes frames in the background, as net.Pipe writes block until read
+func writeFrames(c net.Conn, mask bool, t *testing.T, frames ...*wsFrame) {
+	go func() {
+		for _, f := range frames {
+			if err := writeWSFrame(c, f, mask); err != nil {
+				t.Error("cannot write frame", err)
+			}
+		}
+	}()
+}
+
+func readFrameOrFatal(c net.Conn, t *testing.T) *wsFrame {
+	f, err := readWSFrame(c)
+	if err != nil {
+		t.Fatal("cannot read frame", err)
+	}
+	return f
+}
+
+func TestWebSocketFramesAreFiltered(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.OnWebSocketMessage().DoFunc(func(msg *WSMessage, dir Direction, ctx *ProxyCtx) *WSMessage {
+		if string(msg.Data) == "drop" {
+			return nil
+		}
+		msg.Data = append([]byte(dir.String()+":"), msg.Data...)
+		return msg
+	})
+	client, proxyClient := net.Pipe()
+	proxyUpstream, server := net.Pipe()
+	ctx := &ProxyCtx{Req: &http.Request{}, proxy: proxy}
+	go proxy.pumpWebSocket(ctx, proxyClient, proxyUpstream, nil, nil)
+	defer client.Close()
+	defer server.Close()
+
+	// fragmented message, with a control frame in the middle
+	writeFrames(client, true, t,
+		&wsFrame{opcode: WSTextMessage, payload: []byte("hel")},
+		&wsFrame{fin: true, opcode: wsPing, payload: []byte("ping")},
+		&wsFrame{fin: true, opcode: wsContinuation, payload: []byte("lo")})
+	if f := readFrameOrFatal(server, t); f.opcode != wsPing || string(f.payload) != "ping" {
+		t.Error("control frames should be relayed as is, got", f.opcode, string(f.payload))
+	}
+	if f := readFrameOrFatal(server, t); !f.fin || f.opcode != WSTextMessage || string(f.payload) != "client->server:hello" {
+		t.Error("expected filtered reassembled message, got", f.opcode, string(f.payload))
+	}
+
+	writeFrames(server, false, t,
+		&wsFrame{fin: true, opcode: WSBinaryMessage, payload: []byte("drop")},
+		&wsFrame{fin: true, opcode: WSBinaryMessage, payload: []byte("bye")})
+	if f := readFrameOrFatal(client, t); f.opcode != WSBinaryMessage || string(f.payload) != "server->client:bye" {
+		t.Error("expected dropped message to be skipped, got", f.opcode, string(f.payload))
+	}
+}
+
+func TestWebSocketPerMessageDeflate(t *testing.T) {
+	h := http.Header{}
+	h.Set("Sec-WebSocket-Extensions", "permessage-deflate; client_no_context_takeover; client_max_window_bits=10")
+	clientDeflate, serverDeflate, ok := parseWSExtensions(h)
+	if !ok || clientDeflate == nil || clientDeflate.contextTakeover || clientDeflate.fullWindow ||
+		!serverDeflate.contextTakeover || !serverDeflate.fullWindow {
+		t.Fatal("wrong permessage-deflate parameters", clientDeflate, serverDeflate, ok)
+	}
+	h.Set("Sec-WebSocket-Extensions", "x-webkit-deflate-frame")
+	if _, _, ok := parseWSExtensions(h); ok {
+		t.Error("unknown extensions should not be accepted")
+	}
+
+	// the server compresses two messages with the same LZ77 window
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	var compressed [][]byte
+	for _, msg := range []string{"repeated message", "repeated message"} {
+		fw.Write([]byte(msg))
+		fw.Flush()
+		compressed = append(compressed, bytes.TrimSuffix(append([]byte(nil), buf.Bytes()...), wsTail[:4]))
+		buf.Reset()
+	}
+	for i, c := range compressed {
+		data, err := serverDeflate.inflate(c)
+		if err != nil || string(data) != "repeated message" {
+			t.Fatal("cannot inflate message", i, string(data), err)
+		}
+	}
+
+	proxy := NewProxyHttpServer()
+	proxy.OnWebSocketMessage().DoFunc(func(msg *WSMessage, dir Direction, ctx *ProxyCtx) *WSMessage {
+		return msg
+	})
+	client, proxyClient := net.Pipe()
+	proxyUpstream, server := net.Pipe()
+	ctx := &ProxyCtx{Req: &http.Request{}, proxy: proxy}
+	go proxy.pumpWebSocket(ctx, proxyClient, proxyUpstream, clientDeflate, &wsDeflate{contextTakeover: true, fullWindow: true})
+	defer client.Close()
+	defer server.Close()
+
+	writeFrames(server, false, t, &wsFrame{fin: true, rsv1: true, opcode: WSTextMessage, payload: compressed[0]})
+	f := readFrameOrFatal(client, t)
+	if !f.rsv1 {
+		t.Fatal("messages to the client should be compressed")
+	}
+	if data, err := (&wsDeflate{}).inflate(f.payload); err != nil || string(data) != "repeated message" {
+		t.Error("wrong message relayed to client", string(data), err)
+	}
+	writeFrames(client, true, t, &wsFrame{fin: true, opcode: WSTextMessage, payload: []byte("hi")})
+	if f := readFrameOrFatal(server, t); f.rsv1 || string(f.payload) != "hi" {
+		t.Error("messages to a server with a small window should not be compressed", f.rsv1, string(f.payload))
+	}
+}